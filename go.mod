@@ -1,6 +1,6 @@
 module github.com/schollz/croc/v8
 
-go 1.13
+go 1.16
 
 require (
 	github.com/OneOfOne/xxhash v1.2.5 // indirect
@@ -8,6 +8,7 @@ require (
 	github.com/cpuguy83/go-md2man/v2 v2.0.0 // indirect
 	github.com/denisbrodbeck/machineid v1.0.1
 	github.com/kalafut/imohash v1.0.0
+	github.com/klauspost/compress v1.11.13
 	github.com/kr/pretty v0.1.0 // indirect
 	github.com/schollz/cli/v2 v2.2.1
 	github.com/schollz/logger v1.2.0
@@ -15,12 +16,12 @@ require (
 	github.com/schollz/pake/v2 v2.0.4
 	github.com/schollz/peerdiscovery v1.6.0
 	github.com/schollz/progressbar/v3 v3.6.2
-	github.com/spaolacci/murmur3 v1.1.0 // indirect
+	github.com/spaolacci/murmur3 v1.1.0
 	github.com/stretchr/testify v1.4.0
 	github.com/tscholl2/siec v0.0.0-20191122224205-8da93652b094
 	golang.org/x/crypto v0.0.0-20201016220609-9e8e0b390897
 	golang.org/x/net v0.0.0-20201022231255-08b38378de70
-	golang.org/x/sys v0.0.0-20201022201747-fb209a7c41cd // indirect
+	golang.org/x/sys v0.0.0-20201022201747-fb209a7c41cd
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
 	gopkg.in/yaml.v2 v2.2.7 // indirect
 )
@@ -16,6 +16,7 @@ import (
 	"github.com/schollz/cli/v2"
 	"github.com/schollz/croc/v8/src/comm"
 	"github.com/schollz/croc/v8/src/croc"
+	"github.com/schollz/croc/v8/src/crypt"
 	"github.com/schollz/croc/v8/src/models"
 	"github.com/schollz/croc/v8/src/tcp"
 	"github.com/schollz/croc/v8/src/utils"
@@ -83,7 +84,15 @@ func Run() (err error) {
 		&cli.BoolFlag{Name: "yes", Usage: "automatically agree to all prompts"},
 		&cli.BoolFlag{Name: "stdout", Usage: "redirect file to stdout"},
 		&cli.BoolFlag{Name: "no-compress", Usage: "disable compression"},
+		&cli.BoolFlag{Name: "no-metadata", Usage: "do not preserve modification times, permissions and owners"},
+		&cli.StringFlag{Name: "conflict", Value: string(croc.ConflictOverwrite), Usage: "what to do when a received file already exists (overwrite, skip, rename or prompt)"},
+		&cli.StringFlag{Name: "symlinks", Value: string(croc.SymlinkInside), Usage: "symlinks to accept when receiving (refuse, inside the output folder or allow)"},
+		&cli.StringFlag{Name: "archive", Usage: "receive into a .tar, .tar.gz or .zip archive at this path, or - for stdout"},
+		&cli.StringFlag{Name: "archive-format", Usage: "format of the archive (tar, tar.gz or zip), if not given by its extension"},
+		&cli.StringFlag{Name: "throttle", Usage: "limit the rate of the transfer, such as 5M for 5 MB per second"},
+		&cli.StringFlag{Name: "cipher", Usage: "cipher of the transfer (aes-gcm, chacha20-poly1305 or xchacha20-poly1305), if not chosen for the CPUs"},
 		&cli.BoolFlag{Name: "ask", Usage: "make sure sender and recipient are prompted"},
+		&cli.BoolFlag{Name: "verify", Usage: "make sure sender and recipient confirm that their verification codes match"},
 		&cli.BoolFlag{Name: "local", Usage: "force to use only local connections"},
 		&cli.StringFlag{Name: "relay", Value: models.DEFAULT_RELAY, Usage: "address of the relay", EnvVars: []string{"CROC_RELAY"}},
 		&cli.StringFlag{Name: "relay6", Value: models.DEFAULT_RELAY6, Usage: "ipv6 address of the relay", EnvVars: []string{"CROC_RELAY6"}},
@@ -182,6 +191,9 @@ func send(c *cli.Context) (err error) {
 		RelayPassword:  determinePass(c),
 		SendingText:    c.String("text") != "",
 		NoCompress:     c.Bool("no-compress"),
+		Throttle:       c.String("throttle"),
+		Cipher:         crypt.Cipher(c.String("cipher")),
+		Verify:         c.Bool("verify"),
 	}
 	if crocOptions.RelayAddress != models.DEFAULT_RELAY {
 		crocOptions.RelayAddress6 = ""
@@ -212,21 +224,23 @@ func send(c *cli.Context) (err error) {
 		if !c.IsSet("pass") {
 			crocOptions.RelayPassword = rememberedOptions.RelayPassword
 		}
+		if !c.IsSet("throttle") {
+			crocOptions.Throttle = rememberedOptions.Throttle
+		}
+		if !c.IsSet("cipher") {
+			crocOptions.Cipher = rememberedOptions.Cipher
+		}
+		if !c.IsSet("verify") {
+			crocOptions.Verify = rememberedOptions.Verify
+		}
 	}
 
 	var fnames []string
+	var stream io.Reader
 	stat, _ := os.Stdin.Stat()
 	if (stat.Mode() & os.ModeCharDevice) == 0 {
-		fnames, err = getStdin()
-		if err != nil {
-			return
-		}
-		defer func() {
-			err = os.Remove(fnames[0])
-			if err != nil {
-				log.Error(err)
-			}
-		}()
+		// stdin is sent as it is read
+		stream = os.Stdin
 	} else if c.String("text") != "" {
 		fnames, err = makeTempFileWithString(c.String("text"))
 		if err != nil {
@@ -242,7 +256,7 @@ func send(c *cli.Context) (err error) {
 	} else {
 		fnames = c.Args().Slice()
 	}
-	if len(fnames) == 0 {
+	if len(fnames) == 0 && stream == nil {
 		return errors.New("must specify file: croc send [filename]")
 	}
 
@@ -267,28 +281,12 @@ func send(c *cli.Context) (err error) {
 	err = cr.Send(croc.TransferOptions{
 		PathToFiles:      paths,
 		KeepPathInRemote: haveFolder,
+		Stream:           stream,
 	})
 
 	return
 }
 
-func getStdin() (fnames []string, err error) {
-	f, err := ioutil.TempFile(".", "croc-stdin-")
-	if err != nil {
-		return
-	}
-	_, err = io.Copy(f, os.Stdin)
-	if err != nil {
-		return
-	}
-	err = f.Close()
-	if err != nil {
-		return
-	}
-	fnames = []string{f.Name()}
-	return
-}
-
 func makeTempFileWithString(s string) (fnames []string, err error) {
 	f, err := ioutil.TempFile(".", "croc-stdin-")
 	if err != nil {
@@ -320,14 +318,23 @@ func getPaths(fnames []string) (paths []string, haveFolder bool, err error) {
 		}
 		if stat.IsDir() {
 			haveFolder = true
+			// the current directory itself is not sent, only what is in it
+			skipRoot := false
+			cwd, errCwd := os.Getwd()
+			absFname, errAbs := filepath.Abs(fname)
+			if errCwd == nil && errAbs == nil {
+				skipRoot = filepath.Clean(cwd) == absFname
+			}
 			err = filepath.Walk(fname,
 				func(pathName string, info os.FileInfo, err error) error {
 					if err != nil {
 						return err
 					}
-					if !info.IsDir() {
-						paths = append(paths, filepath.ToSlash(pathName))
+					if skipRoot && pathName == fname {
+						return nil
 					}
+					// directories are sent too, so that empty ones are kept
+					paths = append(paths, filepath.ToSlash(pathName))
 					return nil
 				})
 			if err != nil {
@@ -366,16 +373,24 @@ func saveConfig(c *cli.Context, crocOptions croc.Options) {
 func receive(c *cli.Context) (err error) {
 	comm.Socks5Proxy = c.String("socks5")
 	crocOptions := croc.Options{
-		SharedSecret:  c.String("code"),
-		IsSender:      false,
-		Debug:         c.Bool("debug"),
-		NoPrompt:      c.Bool("yes"),
-		RelayAddress:  c.String("relay"),
-		RelayAddress6: c.String("relay6"),
-		Stdout:        c.Bool("stdout"),
-		Ask:           c.Bool("ask"),
-		RelayPassword: determinePass(c),
-		OnlyLocal:     c.Bool("local"),
+		SharedSecret:   c.String("code"),
+		IsSender:       false,
+		Debug:          c.Bool("debug"),
+		NoPrompt:       c.Bool("yes"),
+		RelayAddress:   c.String("relay"),
+		RelayAddress6:  c.String("relay6"),
+		Stdout:         c.Bool("stdout"),
+		Ask:            c.Bool("ask"),
+		RelayPassword:  determinePass(c),
+		OnlyLocal:      c.Bool("local"),
+		NoMetadata:     c.Bool("no-metadata"),
+		SymlinkPolicy:  croc.SymlinkPolicy(c.String("symlinks")),
+		ConflictPolicy: croc.ConflictPolicy(c.String("conflict")),
+		Archive:        c.String("archive"),
+		ArchiveFormat:  croc.ArchiveFormat(c.String("archive-format")),
+		Throttle:       c.String("throttle"),
+		Cipher:         crypt.Cipher(c.String("cipher")),
+		Verify:         c.Bool("verify"),
 	}
 	if crocOptions.RelayAddress != models.DEFAULT_RELAY {
 		crocOptions.RelayAddress6 = ""
@@ -422,11 +437,36 @@ func receive(c *cli.Context) (err error) {
 		if !c.IsSet("pass") {
 			crocOptions.RelayPassword = rememberedOptions.RelayPassword
 		}
+		if !c.IsSet("no-metadata") {
+			crocOptions.NoMetadata = rememberedOptions.NoMetadata
+		}
+		if !c.IsSet("symlinks") && rememberedOptions.SymlinkPolicy != "" {
+			crocOptions.SymlinkPolicy = rememberedOptions.SymlinkPolicy
+		}
+		if !c.IsSet("conflict") && rememberedOptions.ConflictPolicy != "" {
+			crocOptions.ConflictPolicy = rememberedOptions.ConflictPolicy
+		}
+		if !c.IsSet("throttle") {
+			crocOptions.Throttle = rememberedOptions.Throttle
+		}
+		if !c.IsSet("cipher") {
+			crocOptions.Cipher = rememberedOptions.Cipher
+		}
+		if !c.IsSet("verify") {
+			crocOptions.Verify = rememberedOptions.Verify
+		}
 	}
 
 	if crocOptions.SharedSecret == "" {
 		crocOptions.SharedSecret = utils.GetInput("Enter receive code: ")
 	}
+	if crocOptions.Archive != "" && crocOptions.Archive != "-" {
+		// the archive is not put in the output folder
+		crocOptions.Archive, err = filepath.Abs(crocOptions.Archive)
+		if err != nil {
+			return
+		}
+	}
 	if c.String("out") != "" {
 		if err = os.Chdir(c.String("out")); err != nil {
 			return err
@@ -3,11 +3,114 @@ package compress
 import (
 	"bytes"
 	"compress/flate"
+	"errors"
+	"fmt"
 	"io"
+	"sync"
 
+	"github.com/klauspost/compress/zstd"
 	log "github.com/schollz/logger"
 )
 
+// Algorithm is a compression algorithm
+type Algorithm string
+
+const (
+	// Flate is the compression of Compress
+	Flate Algorithm = "flate"
+	// Zstd is zstandard, which is faster than flate for the same savings
+	Zstd Algorithm = "zstd"
+)
+
+// Algorithms lists the supported algorithms in order of preference
+var Algorithms = []Algorithm{Zstd, Flate}
+
+// ErrTooLarge is returned when data decompresses to more than its limit
+var ErrTooLarge = errors.New("decompressed data is too large")
+
+var (
+	zstdOnce     sync.Once
+	zstdEncoder  *zstd.Encoder
+	zstdErr      error
+	zstdDecoders sync.Map
+)
+
+// zstdEncoderOf returns the zstd encoder, which is shared
+// as it can be used by several goroutines at once
+func zstdEncoderOf() (*zstd.Encoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	})
+	return zstdEncoder, zstdErr
+}
+
+// zstdDecoderOf returns a zstd decoder that decodes at most limit
+// bytes, which is shared by the decompressions with that limit
+func zstdDecoderOf(limit int) (*zstd.Decoder, error) {
+	if d, ok := zstdDecoders.Load(limit); ok {
+		return d.(*zstd.Decoder), nil
+	}
+	d, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	if existing, loaded := zstdDecoders.LoadOrStore(limit, d); loaded {
+		d.Close()
+		return existing.(*zstd.Decoder), nil
+	}
+	return d, nil
+}
+
+// CompressWith returns src compressed with the algorithm
+func CompressWith(src []byte, algorithm Algorithm) (dst []byte, err error) {
+	switch algorithm {
+	case Flate:
+		return Compress(src), nil
+	case Zstd:
+		encoder, err := zstdEncoderOf()
+		if err != nil {
+			return nil, err
+		}
+		return encoder.EncodeAll(src, nil), nil
+	}
+	return nil, fmt.Errorf("unknown compression '%s'", algorithm)
+}
+
+// DecompressWith returns src decompressed with the algorithm,
+// or ErrTooLarge if it is more than limit bytes
+func DecompressWith(src []byte, algorithm Algorithm, limit int) (dst []byte, err error) {
+	switch algorithm {
+	case Flate:
+		return DecompressLimit(src, limit)
+	case Zstd:
+		decoder, err := zstdDecoderOf(limit)
+		if err != nil {
+			return nil, err
+		}
+		dst, err = decoder.DecodeAll(src, nil)
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) || len(dst) > limit {
+			return nil, ErrTooLarge
+		}
+		return dst, err
+	}
+	return nil, fmt.Errorf("unknown compression '%s'", algorithm)
+}
+
+// DecompressLimit returns src decompressed as by Decompress,
+// or ErrTooLarge if it is more than limit bytes
+func DecompressLimit(src []byte, limit int) (dst []byte, err error) {
+	decompressor := flate.NewReader(bytes.NewReader(src))
+	defer decompressor.Close()
+	dst, err = io.ReadAll(io.LimitReader(decompressor, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(dst) > limit {
+		return nil, ErrTooLarge
+	}
+	return
+}
+
 // CompressWithOption returns compressed data using the specified level
 func CompressWithOption(src []byte, level int) []byte {
 	compressedData := new(bytes.Buffer)
@@ -22,7 +125,8 @@ func Compress(src []byte) []byte {
 	return compressedData.Bytes()
 }
 
-// Decompress returns a decompressed byte slice.
+// Decompress returns a decompressed byte slice. It is not limited,
+// so DecompressLimit is used for data from a peer.
 func Decompress(src []byte) []byte {
 	compressedData := bytes.NewBuffer(src)
 	deCompressedData := new(bytes.Buffer)
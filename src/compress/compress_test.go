@@ -103,3 +103,42 @@ func TestCompress(t *testing.T) {
 	fmt.Printf("random, Level 9: %2.0f%% percent space savings\n", dataRateSavings)
 
 }
+
+func TestCompressWith(t *testing.T) {
+	for _, algorithm := range Algorithms {
+		compressedB, err := CompressWith(fable, algorithm)
+		assert.Nil(t, err)
+		assert.True(t, len(compressedB) < len(fable), algorithm)
+		b, err := DecompressWith(compressedB, algorithm, len(fable))
+		assert.Nil(t, err)
+		assert.Equal(t, fable, b, algorithm)
+
+		_, err = DecompressWith(compressedB, algorithm, len(fable)-1)
+		assert.Equal(t, ErrTooLarge, err, algorithm)
+		_, err = DecompressWith(fable, algorithm, len(fable))
+		assert.NotNil(t, err, algorithm)
+	}
+	_, err := CompressWith(fable, "lzma")
+	assert.NotNil(t, err)
+}
+
+func TestDecompressLimit(t *testing.T) {
+	// a bomb that is small but decompresses to 64 MB
+	bomb := make([]byte, 64<<20)
+	zstdBomb, err := CompressWith(bomb, Zstd)
+	assert.Nil(t, err)
+	for algorithm, compressedB := range map[Algorithm][]byte{
+		Zstd:  zstdBomb,
+		Flate: CompressWithOption(bomb, 9),
+	} {
+		assert.True(t, len(compressedB) < 1<<20, algorithm)
+		_, err = DecompressWith(compressedB, algorithm, 1<<20)
+		assert.Equal(t, ErrTooLarge, err, algorithm)
+	}
+
+	b, err := DecompressLimit(Compress(fable), len(fable))
+	assert.Nil(t, err)
+	assert.Equal(t, fable, b)
+	_, err = DecompressLimit(Compress(fable), 100)
+	assert.Equal(t, ErrTooLarge, err)
+}
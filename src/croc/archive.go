@@ -0,0 +1,250 @@
+package croc
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/schollz/logger"
+)
+
+// ArchiveFormat is the format of an archive that files are received into
+type ArchiveFormat string
+
+const (
+	// ArchiveTar is an uncompressed tar archive
+	ArchiveTar ArchiveFormat = "tar"
+	// ArchiveTarGz is a gzip compressed tar archive
+	ArchiveTarGz ArchiveFormat = "tar.gz"
+	// ArchiveZip is a zip archive
+	ArchiveZip ArchiveFormat = "zip"
+)
+
+// archiveFormatOf returns the format of an archive by its extension
+func archiveFormatOf(name string) (format ArchiveFormat, ok bool) {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return ArchiveTarGz, true
+	case strings.HasSuffix(name, ".tar"):
+		return ArchiveTar, true
+	case strings.HasSuffix(name, ".zip"):
+		return ArchiveZip, true
+	}
+	return "", false
+}
+
+// archiveSink writes the files it receives as entries of an archive
+type archiveSink struct {
+	tw *tar.Writer
+	gw *gzip.Writer
+	zw *zip.Writer
+	// file is the archive on disk, which is nil if it is written to stdout
+	file *os.File
+}
+
+func newArchiveSink(w io.Writer, format ArchiveFormat) *archiveSink {
+	s := new(archiveSink)
+	switch format {
+	case ArchiveZip:
+		s.zw = zip.NewWriter(w)
+	case ArchiveTarGz:
+		s.gw = gzip.NewWriter(w)
+		s.tw = tar.NewWriter(s.gw)
+	default:
+		s.tw = tar.NewWriter(w)
+	}
+	return s
+}
+
+// archiveMode returns the mode of an entry, or perm if the sender did not send one
+func archiveMode(fileInfo FileInfo, perm os.FileMode) os.FileMode {
+	if fileInfo.Mode != 0 {
+		return fileInfo.Mode.Perm()
+	}
+	return perm
+}
+
+// archiveModTime returns the modification time of an entry,
+// which is now if the sender did not send one
+func archiveModTime(fileInfo FileInfo) time.Time {
+	if fileInfo.ModTime.IsZero() {
+		return time.Now()
+	}
+	return fileInfo.ModTime
+}
+
+func (s *archiveSink) tarHeader(name string, fileInfo FileInfo, perm os.FileMode) *tar.Header {
+	return &tar.Header{
+		Name:    name,
+		Mode:    int64(archiveMode(fileInfo, perm)),
+		Uid:     fileInfo.UID,
+		Gid:     fileInfo.GID,
+		ModTime: archiveModTime(fileInfo),
+		Format:  tar.FormatPAX,
+	}
+}
+
+func (s *archiveSink) zipHeader(name string, fileInfo FileInfo, mode os.FileMode) *zip.FileHeader {
+	hdr := &zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: archiveModTime(fileInfo),
+	}
+	hdr.SetMode(mode)
+	return hdr
+}
+
+func (s *archiveSink) Create(name string, fileInfo FileInfo) (SinkFile, error) {
+	if s.zw != nil {
+		w, err := s.zw.CreateHeader(s.zipHeader(name, fileInfo, archiveMode(fileInfo, 0644)))
+		if err != nil {
+			return nil, err
+		}
+		return newReorderWriter(w), nil
+	}
+	if fileInfo.IsStream {
+		// the size of a tar entry comes before its data
+		return s.spool(name, fileInfo)
+	}
+	hdr := s.tarHeader(name, fileInfo, 0644)
+	hdr.Typeflag = tar.TypeReg
+	hdr.Size = fileInfo.Size
+	if err := s.tw.WriteHeader(hdr); err != nil {
+		return nil, err
+	}
+	return newReorderWriter(s.tw), nil
+}
+
+func (s *archiveSink) Mkdir(name string, fileInfo FileInfo) (err error) {
+	if s.zw != nil {
+		_, err = s.zw.CreateHeader(s.zipHeader(name+"/", fileInfo, os.ModeDir|archiveMode(fileInfo, 0755)))
+		return
+	}
+	hdr := s.tarHeader(name+"/", fileInfo, 0755)
+	hdr.Typeflag = tar.TypeDir
+	return s.tw.WriteHeader(hdr)
+}
+
+func (s *archiveSink) Symlink(name string, fileInfo FileInfo) (err error) {
+	if s.zw != nil {
+		// the target of a symlink is the content of its entry
+		var w io.Writer
+		w, err = s.zw.CreateHeader(s.zipHeader(name, fileInfo, os.ModeSymlink|0777))
+		if err != nil {
+			return
+		}
+		_, err = io.WriteString(w, fileInfo.Symlink)
+		return
+	}
+	hdr := s.tarHeader(name, fileInfo, 0777)
+	hdr.Typeflag = tar.TypeSymlink
+	hdr.Linkname = fileInfo.Symlink
+	return s.tw.WriteHeader(hdr)
+}
+
+func (s *archiveSink) Finalize(name string, fileInfo FileInfo) error {
+	// the metadata is written with each entry
+	return nil
+}
+
+// Close finishes the archive
+func (s *archiveSink) Close() (err error) {
+	if s.zw != nil {
+		return s.zw.Close()
+	}
+	if err = s.tw.Close(); err != nil {
+		return
+	}
+	if s.gw != nil {
+		err = s.gw.Close()
+	}
+	return
+}
+
+// spooledFile is a file of unknown size that is kept in a
+// temporary file until it is complete and added to a tar
+type spooledFile struct {
+	*os.File
+	s      *archiveSink
+	hdr    *tar.Header
+	closed bool
+}
+
+func (s *archiveSink) spool(name string, fileInfo FileInfo) (SinkFile, error) {
+	f, err := ioutil.TempFile("", "croc-spool")
+	if err != nil {
+		return nil, err
+	}
+	hdr := s.tarHeader(name, fileInfo, 0644)
+	hdr.Typeflag = tar.TypeReg
+	return &spooledFile{File: f, s: s, hdr: hdr}, nil
+}
+
+// Close adds the file to the tar
+func (f *spooledFile) Close() (err error) {
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	defer func() {
+		f.File.Close()
+		if errRemove := os.Remove(f.Name()); errRemove != nil {
+			log.Debugf("could not remove %s: %v", f.Name(), errRemove)
+		}
+	}()
+	stat, err := f.Stat()
+	if err != nil {
+		return
+	}
+	f.hdr.Size = stat.Size()
+	if err = f.s.tw.WriteHeader(f.hdr); err != nil {
+		return
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	_, err = io.Copy(f.s.tw, f.File)
+	return
+}
+
+// openArchive starts the archive that files are received into
+func (c *Client) openArchive() (err error) {
+	w := c.stdout
+	var f *os.File
+	if c.Options.Archive != "-" {
+		f, err = os.Create(c.Options.Archive)
+		if err != nil {
+			return
+		}
+		w = f
+	}
+	c.archive = newArchiveSink(w, c.Options.ArchiveFormat)
+	c.archive.file = f
+	c.sink = c.archive
+	return
+}
+
+// closeArchive finishes the archive, which is
+// removed if the transfer was not successful
+func (c *Client) closeArchive() (err error) {
+	err = c.archive.Close()
+	if c.archive.file == nil {
+		return
+	}
+	if errClose := c.archive.file.Close(); err == nil {
+		err = errClose
+	}
+	if !c.SuccessfulTransfer {
+		log.Debugf("removing %s", c.Options.Archive)
+		if errRemove := os.Remove(c.Options.Archive); errRemove != nil {
+			log.Debugf("could not remove %s: %v", c.Options.Archive, errRemove)
+		}
+	}
+	return
+}
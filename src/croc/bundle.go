@@ -0,0 +1,338 @@
+package croc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+
+	log "github.com/schollz/logger"
+
+	"github.com/schollz/croc/v8/src/message"
+)
+
+// Small files are sent together as a bundle, so that each file does not
+// take its own round trips. The data of the files of a bundle is sent in
+// order as a single stream over the first data connection, after which
+// the sender sends the digest of each file. Files are still received,
+// verified and resumed one by one.
+const (
+	// bundleFileSize is the size below which a file is bundled
+	bundleFileSize = 1 << 20
+	// bundleMinFiles is how many files below bundleFileSize
+	// a transfer needs for files to be bundled
+	bundleMinFiles = 8
+	// bundleMaxFiles and bundleMaxSize limit the files of a bundle
+	bundleMaxFiles = 1000
+	bundleMaxSize  = 64 << 20
+)
+
+// BundleFile is a file requested as part of a bundle
+type BundleFile struct {
+	Index int `json:"i"`
+	// VerifyOnly requests only the digest of the file
+	VerifyOnly bool `json:"v,omitempty"`
+}
+
+// shouldBundle reports whether files has enough small files to bundle them
+func shouldBundle(files []FileInfo) bool {
+	small := 0
+	for _, fi := range files {
+		if isBundleable(fi) {
+			small++
+		}
+	}
+	return small >= bundleMinFiles
+}
+
+func isBundleable(fi FileInfo) bool {
+	return fi.Size > 0 && fi.Size < bundleFileSize &&
+		!fi.IsDir && !fi.IsStream && fi.Symlink == ""
+}
+
+// hasBundleData reports whether the data of a file is in a bundle
+func hasBundleData(fi FileInfo, entry BundleFile) bool {
+	return !entry.VerifyOnly && fi.Size > 0 && !fi.IsDir && fi.Symlink == ""
+}
+
+// bundleable reports whether the i-th file is received in a bundle
+func (c *Client) bundleable(i int) bool {
+	if _, failed := c.receiveAlone[i]; failed {
+		// it is verified on its own
+		return false
+	}
+	return c.bundling && !c.rerequest && isBundleable(c.FilesToTransfer[i])
+}
+
+// checkBundle checks that a bundle requested by the recipient is of files
+// that are sent
+func (c *Client) checkBundle(bundle []BundleFile) (err error) {
+	for _, entry := range bundle {
+		if entry.Index < 0 || entry.Index >= len(c.FilesToTransfer) || c.FilesToTransfer[entry.Index].IsStream {
+			return fmt.Errorf("can not bundle file %d", entry.Index)
+		}
+	}
+	return
+}
+
+// sendBundle sends the data of the files of the bundle in order over
+// the first data connection, followed by a chunk that marks its end
+func (c *Client) sendBundle() {
+	bundle := c.bundle
+	digests := make([]*FileDigest, len(bundle))
+	defer func() {
+		c.batchDigestchan <- digests
+	}()
+
+	pos := uint64(0)
+	for k, entry := range bundle {
+		fi := c.FilesToTransfer[entry.Index]
+		if fi.Size == 0 || fi.IsDir || fi.Symlink != "" {
+			continue
+		}
+		started := int64(0)
+		if entry.VerifyOnly {
+			started = fi.Size
+		}
+		c.emit(Event{Type: EventFileStarted, FileIndex: entry.Index, File: fi, Bytes: started})
+		digest, n, err := c.sendBundleFile(entry, pos)
+		if err != nil {
+			if c.ctx.Err() == nil {
+				c.dataError(err)
+			}
+			return
+		}
+		digests[k] = &digest
+		pos += uint64(n)
+		c.emit(Event{Type: EventFileFinished, FileIndex: entry.Index, File: fi})
+	}
+	if err := c.sendChunk(0, bundle[0].Index, streamEnd|pos, nil); err != nil {
+		if c.ctx.Err() == nil {
+			c.dataError(err)
+		}
+	}
+}
+
+// sendBundleFile computes the digest of a file of a bundle and sends
+// its data at pos of the bundle, unless only its digest is requested
+func (c *Client) sendBundleFile(entry BundleFile, pos uint64) (digest FileDigest, sent int64, err error) {
+	fi := c.FilesToTransfer[entry.Index]
+	f, err := c.source.Open(path.Join(fi.FolderSource, fi.Name))
+	if err != nil {
+		err = &TransferError{Op: "open", File: fi.Name, Err: err}
+		return
+	}
+	defer f.Close()
+
+	d := newDigester(fi.Size)
+	r := io.LimitReader(f, fi.Size)
+	var read int64
+	for {
+		if err = c.ctx.Err(); err != nil {
+			return
+		}
+		data := make([]byte, c.chunkSize)
+		n, errRead := io.ReadFull(r, data)
+		read += int64(n)
+		d.Write(data[:n])
+		if n > 0 && !entry.VerifyOnly {
+			if err = c.sendChunk(0, entry.Index, pos+uint64(sent), data[:n]); err != nil {
+				return
+			}
+			c.emit(Event{Type: EventFileProgress, FileIndex: entry.Index, File: fi, Bytes: int64(n)})
+			c.mutex.Lock()
+			c.TotalSent += int64(n)
+			c.mutex.Unlock()
+			sent += int64(n)
+		}
+		if errRead == io.EOF || errRead == io.ErrUnexpectedEOF {
+			break
+		} else if errRead != nil {
+			err = &TransferError{Op: "read", File: fi.Name, Err: errRead}
+			return
+		}
+	}
+	if read != fi.Size {
+		// the recipient splits the bundle by the sizes of its files
+		err = &TransferError{Op: "read", File: fi.Name, Err: fmt.Errorf("file changed size")}
+		return
+	}
+	digest = d.Sum()
+	return
+}
+
+// sendCloseDigests sends the digests of files sent together
+func (c *Client) sendCloseDigests(digests []*FileDigest) (err error) {
+	b, err := json.Marshal(digests)
+	if err != nil {
+		return
+	}
+	return message.Send(c.conn[0], c.Key, message.Message{
+		Type:  "close-recipient",
+		Bytes: b,
+	})
+}
+
+// receiveBundleData writes the data at pos of the bundle to the files it
+// belongs to, creating the files of the bundle as it gets to them. The
+// index is of the file of the data, or -1 if the chunk has no context.
+func (c *Client) receiveBundleData(pos int64, index int, data []byte) (err error) {
+	for len(data) > 0 {
+		if err = c.openBundleEntry(); err != nil {
+			return
+		}
+		if err = checkChunkIndex(index, c.FilesToTransferCurrentNum); err != nil {
+			return
+		}
+		fi := c.FilesToTransfer[c.FilesToTransferCurrentNum]
+		off := pos - c.bundlePos
+		if off < 0 {
+			return &TransferError{Op: "decode", File: fi.Name, Err: fmt.Errorf("bundle data out of order")}
+		}
+		n := int64(len(data))
+		if off+n > fi.Size {
+			n = fi.Size - off
+		}
+		if err = c.writeReceived(data[:n], off); err != nil {
+			return &TransferError{Op: "write", File: fi.Name, Err: err}
+		}
+		c.emit(Event{Type: EventFileProgress, FileIndex: c.FilesToTransferCurrentNum, File: fi, Bytes: n})
+		pos += n
+		data = data[n:]
+		if off+n == fi.Size {
+			if err = c.closeBundleEntry(); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// openBundleEntry gets to the next file of the bundle with data and
+// opens it, unless one is open already. The files before it without
+// data are created or started to be verified on the way.
+func (c *Client) openBundleEntry() (err error) {
+	for !c.bundleFileOpen {
+		if c.bundleEntry >= len(c.bundle) {
+			return &TransferError{Op: "decode", Err: fmt.Errorf("bundle data past its files")}
+		}
+		entry := c.bundle[c.bundleEntry]
+		fi := c.FilesToTransfer[entry.Index]
+		if hasBundleData(fi, entry) {
+			c.FilesToTransferCurrentNum = entry.Index
+			c.verifyOnly = false
+			c.rerequest = false
+			if err = c.recipientInitializeFile(); err != nil {
+				return
+			}
+			if c.journal != nil {
+				// all of it is in the bundle
+				c.journal.reset(entry.Index)
+			}
+			c.emit(Event{Type: EventFileStarted, FileIndex: entry.Index, File: fi})
+			c.bundleFileOpen = true
+			return
+		}
+		if err = c.skipBundleEntry(entry); err != nil {
+			return
+		}
+		c.bundleEntry++
+	}
+	return
+}
+
+// skipBundleEntry handles a file of the bundle without data
+func (c *Client) skipBundleEntry(entry BundleFile) (err error) {
+	fi := c.FilesToTransfer[entry.Index]
+	if entry.VerifyOnly {
+		c.emit(Event{Type: EventFileStarted, FileIndex: entry.Index, File: fi, Bytes: fi.Size})
+		return
+	}
+	return c.createEmptyFileAndFinish(fi, entry.Index)
+}
+
+// closeBundleEntry closes the file of the bundle that is received
+func (c *Client) closeBundleEntry() (err error) {
+	entry := c.bundle[c.bundleEntry]
+	fi := c.FilesToTransfer[entry.Index]
+	c.emit(Event{Type: EventFileFinished, FileIndex: entry.Index, File: fi})
+	if c.sink != nil {
+		c.bundleSinkDigests[entry.Index] = c.sinkDigest
+	}
+	if err = c.closeReceivedFile(); err != nil {
+		return
+	}
+	c.bundlePos += fi.Size
+	c.bundleEntry++
+	c.bundleFileOpen = false
+	return
+}
+
+// receiveBundleEnd handles the files after the last data of the bundle
+func (c *Client) receiveBundleEnd() (err error) {
+	if c.bundleFileOpen {
+		fi := c.FilesToTransfer[c.FilesToTransferCurrentNum]
+		return &TransferError{Op: "receive", File: fi.Name, Err: fmt.Errorf("bundle ended early")}
+	}
+	for ; c.bundleEntry < len(c.bundle); c.bundleEntry++ {
+		entry := c.bundle[c.bundleEntry]
+		if hasBundleData(c.FilesToTransfer[entry.Index], entry) {
+			fi := c.FilesToTransfer[entry.Index]
+			return &TransferError{Op: "receive", File: fi.Name, Err: fmt.Errorf("bundle ended early")}
+		}
+		if err = c.skipBundleEntry(entry); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// recipientVerifyBundle checks the files of the bundle against
+// their digests from the sender
+func (c *Client) recipientVerifyBundle(b []byte) (err error) {
+	bundle := c.bundle
+	c.bundle = nil
+	return c.recipientVerifyBatch(b, bundle)
+}
+
+// recipientVerifyBatch checks files that were received together against
+// their digests from the sender. Files that do not match are left to be
+// received on their own.
+func (c *Client) recipientVerifyBatch(b []byte, files []BundleFile) (err error) {
+	var digests []*FileDigest
+	if err = json.Unmarshal(b, &digests); err != nil {
+		return
+	}
+	if len(digests) != len(files) {
+		return fmt.Errorf("got %d digests for %d files", len(digests), len(files))
+	}
+	for k, entry := range files {
+		if digests[k] == nil {
+			// created without data
+			continue
+		}
+		c.FilesToTransferCurrentNum = entry.Index
+		c.verifyOnly = entry.VerifyOnly
+		c.rerequest = false
+		c.verifyAttempts = 0
+		c.sinkDigest = c.bundleSinkDigests[entry.Index]
+		delete(c.bundleSinkDigests, entry.Index)
+		var bDigest []byte
+		if bDigest, err = json.Marshal(digests[k]); err != nil {
+			return
+		}
+		if err = c.recipientVerifyFile(bDigest); err != nil {
+			return
+		}
+		if c.rerequest {
+			log.Debugf("%s did not match, receiving it on its own", c.FilesToTransfer[entry.Index].Name)
+			c.receiveAlone[entry.Index] = struct{}{}
+		}
+	}
+	c.FilesToTransferCurrentNum = files[0].Index
+	c.verifyOnly = false
+	c.rerequest = false
+	c.verifyAttempts = 0
+	c.verifyChunkRanges = nil
+	return
+}
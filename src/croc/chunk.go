@@ -0,0 +1,88 @@
+package croc
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// With a recipient that checks the context of the chunks, the position
+// and file index of each chunk are sent before its encrypted data, which
+// is authenticated with them and the direction it is sent in as associated
+// data. A chunk can then not be replayed as that of another file or of
+// another position, and the key of the session binds it to the session.
+const (
+	// chunkContextSize is the size of the position and file
+	// index that are sent before the data of a chunk
+	chunkContextSize = 12
+	// chunkFromSender is the direction of the chunks
+	// that the sender sends to the recipient
+	chunkFromSender byte = 's'
+)
+
+// chunkAssociatedData returns the associated data of a chunk
+// with the context, which is its position and file index
+func chunkAssociatedData(direction byte, context []byte) []byte {
+	ad := make([]byte, 0, 1+len(context))
+	ad = append(ad, direction)
+	return append(ad, context...)
+}
+
+// sealChunk returns a chunk with its header and data encrypted
+// to be sent over the i-th data connection
+func (c *Client) sealChunk(i, index int, header, data []byte) (chunk []byte, err error) {
+	if !c.chunkContext {
+		return c.sealData(i, c.encodeChunk(i, index, header, data), nil)
+	}
+	context := make([]byte, chunkContextSize)
+	copy(context, header[:8])
+	binary.LittleEndian.PutUint32(context[8:], uint32(index))
+	sealed, err := c.sealData(i, c.encodeChunk(i, index, nil, data),
+		chunkAssociatedData(chunkFromSender, context))
+	if err != nil {
+		return
+	}
+	return append(context, sealed...), nil
+}
+
+// openChunk decrypts a chunk received over the i-th data connection and
+// returns its header and data, which is headerSize bytes of header, and
+// the index of its file, which is -1 if the chunk has no context
+func (c *Client) openChunk(i int, chunk []byte, headerSize int) (index int, data []byte, err error) {
+	index = -1
+	if !c.chunkContext {
+		data, err = c.openData(i, chunk, nil)
+		if err != nil {
+			return index, nil, &TransferError{Op: "decrypt", File: c.currentFileName(), Err: err}
+		}
+		data, err = c.decodeChunk(data, headerSize)
+		if err != nil {
+			return index, nil, &TransferError{Op: "decompress", File: c.currentFileName(), Err: err}
+		}
+		return
+	}
+
+	if len(chunk) < chunkContextSize {
+		return index, nil, &TransferError{Op: "decode", File: c.currentFileName(), Err: fmt.Errorf("chunk too short")}
+	}
+	context := chunk[:chunkContextSize]
+	index = int(binary.LittleEndian.Uint32(context[8:]))
+	data, err = c.openData(i, chunk[chunkContextSize:],
+		chunkAssociatedData(chunkFromSender, context))
+	if err != nil {
+		return index, nil, &TransferError{Op: "decrypt", File: c.currentFileName(), Err: err}
+	}
+	data, err = c.decodeChunk(data, 0)
+	if err != nil {
+		return index, nil, &TransferError{Op: "decompress", File: c.currentFileName(), Err: err}
+	}
+	return index, append(append(make([]byte, 0, headerSize+len(data)), context[:headerSize]...), data...), nil
+}
+
+// checkChunkIndex checks that a chunk is of the expected file,
+// unless its index is -1 as it has no context
+func checkChunkIndex(index, expected int) error {
+	if index >= 0 && index != expected {
+		return &TransferError{Op: "decode", Err: fmt.Errorf("chunk of file %d is not requested", index)}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package croc
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/schollz/croc/v8/src/compress"
+)
+
+// With a recipient that chooses a compression algorithm, each chunk is
+// compressed only if a trial compression saves enough, and the first
+// byte of its header tells how its data is compressed. The position
+// and the rest of the header are not compressed.
+const (
+	chunkRaw byte = iota
+	chunkFlate
+	chunkZstd
+)
+
+const (
+	// compressMaxRatio is the most that compressed data can be of the
+	// data for the compression to be used
+	compressMaxRatio = 0.9
+	// compressSkipChunks is how many chunks are not compressed after a
+	// trial that did not save enough, until the next trial
+	compressSkipChunks = 16
+)
+
+// compressedExtensions are of files whose data is compressed already
+var compressedExtensions = map[string]struct{}{
+	".7z": {}, ".avi": {}, ".br": {}, ".bz2": {}, ".deb": {}, ".docx": {},
+	".flac": {}, ".gif": {}, ".gz": {}, ".heic": {}, ".jar": {}, ".jpeg": {},
+	".jpg": {}, ".lz4": {}, ".mkv": {}, ".mov": {}, ".mp3": {}, ".mp4": {},
+	".ogg": {}, ".png": {}, ".rar": {}, ".rpm": {}, ".tgz": {}, ".webm": {},
+	".webp": {}, ".xlsx": {}, ".xz": {}, ".zip": {}, ".zst": {},
+}
+
+// isCompressedName reports whether a file seems compressed by its name
+func isCompressedName(name string) bool {
+	_, ok := compressedExtensions[strings.ToLower(filepath.Ext(name))]
+	return ok
+}
+
+// chunkMethod returns the header byte of the chunks compressed
+// with the algorithm
+func chunkMethod(algorithm compress.Algorithm) byte {
+	switch algorithm {
+	case compress.Zstd:
+		return chunkZstd
+	case compress.Flate:
+		return chunkFlate
+	}
+	return chunkRaw
+}
+
+// chooseCompression returns the first of the algorithms offered by
+// the sender that is supported, or "" if there is none
+func chooseCompression(offered []compress.Algorithm) compress.Algorithm {
+	for _, algorithm := range offered {
+		for _, supported := range compress.Algorithms {
+			if algorithm == supported {
+				return algorithm
+			}
+		}
+	}
+	return ""
+}
+
+// chunkCompressor decides whether to compress the chunks
+// sent over a data connection
+type chunkCompressor struct {
+	algorithm compress.Algorithm
+	// index is of the file of the last chunk
+	index int
+	skip  int
+}
+
+// compress returns the data of a chunk of the index-th file
+// and the header byte of how it is compressed
+func (cc *chunkCompressor) compress(index int, fileInfo FileInfo, data []byte) (method byte, out []byte) {
+	if index != cc.index {
+		// each file gets its own trial
+		cc.index = index
+		cc.skip = 0
+	}
+	if cc.algorithm == "" || fileInfo.IsCompressed || len(data) == 0 {
+		return chunkRaw, data
+	}
+	if cc.skip > 0 {
+		cc.skip--
+		return chunkRaw, data
+	}
+	out, err := compress.CompressWith(data, cc.algorithm)
+	if err != nil || float64(len(out)) > compressMaxRatio*float64(len(data)) {
+		cc.skip = compressSkipChunks
+		return chunkRaw, data
+	}
+	return chunkMethod(cc.algorithm), out
+}
+
+// senderInitializeCompression sets the algorithm that the recipient chose
+func (c *Client) senderInitializeCompression(algorithm compress.Algorithm) (err error) {
+	if algorithm != "" && chooseCompression([]compress.Algorithm{algorithm}) == "" {
+		return fmt.Errorf("unknown compression '%s'", algorithm)
+	}
+	c.compression = algorithm
+	if c.Options.NoCompress {
+		algorithm = ""
+	}
+	c.compressors = make([]*chunkCompressor, len(c.Options.RelayPorts))
+	for i := range c.compressors {
+		c.compressors[i] = &chunkCompressor{algorithm: algorithm, index: -1}
+	}
+	return
+}
+
+// encodeChunk returns a chunk with its header and data
+// to be sent over the i-th data connection
+func (c *Client) encodeChunk(i, index int, header, data []byte) []byte {
+	switch {
+	case c.compression != "":
+		var fileInfo FileInfo
+		if index < len(c.FilesToTransfer) {
+			fileInfo = c.FilesToTransfer[index]
+		}
+		method, out := c.compressors[i].compress(index, fileInfo, data)
+		chunk := make([]byte, 0, 1+len(header)+len(out))
+		chunk = append(chunk, method)
+		chunk = append(chunk, header...)
+		return append(chunk, out...)
+	case c.Options.NoCompress:
+		return append(header, data...)
+	}
+	return compress.Compress(append(header, data...))
+}
+
+// decodeChunk returns the header and data of a chunk, which is
+// headerSize bytes of header if the chunk says how it is compressed
+func (c *Client) decodeChunk(chunk []byte, headerSize int) ([]byte, error) {
+	if c.compression == "" {
+		if c.Options.NoCompress {
+			return chunk, nil
+		}
+		return compress.DecompressLimit(chunk, headerSize+c.chunkLimit())
+	}
+	if len(chunk) < 1+headerSize {
+		return nil, fmt.Errorf("chunk too short")
+	}
+	method, header, data := chunk[0], chunk[1:1+headerSize], chunk[1+headerSize:]
+	var algorithm compress.Algorithm
+	switch method {
+	case chunkRaw:
+		return chunk[1:], nil
+	case chunkFlate:
+		algorithm = compress.Flate
+	case chunkZstd:
+		algorithm = compress.Zstd
+	default:
+		return nil, fmt.Errorf("unknown chunk compression %d", method)
+	}
+	data, err := compress.DecompressWith(data, algorithm, c.chunkLimit())
+	if err != nil {
+		return nil, err
+	}
+	return append(append(make([]byte, 0, len(header)+len(data)), header...), data...), nil
+}
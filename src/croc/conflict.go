@@ -0,0 +1,138 @@
+package croc
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/schollz/logger"
+
+	"github.com/schollz/croc/v8/src/utils"
+)
+
+// ConflictPolicy is what a recipient does when a file it receives
+// already exists with different content
+type ConflictPolicy string
+
+const (
+	// ConflictOverwrite overwrites the existing file, which is the default
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	// ConflictSkip keeps the existing file and does not receive the file
+	ConflictSkip ConflictPolicy = "skip"
+	// ConflictRename receives the file with a numeric suffix added to its name
+	ConflictRename ConflictPolicy = "rename"
+	// ConflictPrompt asks which of the other policies to use for each file
+	ConflictPrompt ConflictPolicy = "prompt"
+)
+
+// conflictFreeName returns the name with the lowest numeric suffix
+// that does not exist in the folder, e.g. "file-1.txt", and that no
+// file to receive has. Files renamed before have their new names.
+func (c *Client) conflictFreeName(folder, name string) string {
+	taken := make(map[string]struct{})
+	for _, fileInfo := range c.FilesToTransfer {
+		taken[path.Join(fileInfo.FolderRemote, fileInfo.Name)] = struct{}{}
+	}
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	if base == "" {
+		// dotfiles have no extension
+		base, ext = name, ""
+	}
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s-%d%s", base, n, ext)
+		if _, ok := taken[path.Join(folder, candidate)]; ok {
+			continue
+		}
+		if _, err := os.Lstat(path.Join(folder, candidate)); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// checkConflict decides what happens to the i-th file if something
+// else already exists where it is received, returning whether the
+// file is skipped. The file is renamed in c.FilesToTransfer if needed.
+func (c *Client) checkConflict(i int, fileHash []byte, errHash error) (skip bool, err error) {
+	fileInfo := c.FilesToTransfer[i]
+	pathToFile := path.Join(fileInfo.FolderRemote, fileInfo.Name)
+	if _, errStat := os.Lstat(pathToFile); errStat != nil {
+		return
+	}
+	if c.journal != nil && len(c.journal.Files[i].Received) > 0 {
+		// the file is being resumed
+		return
+	}
+	same := errHash == nil && bytes.Equal(fileHash, fileInfo.Hash)
+	if fileInfo.Symlink != "" {
+		target, errLink := os.Readlink(pathToFile)
+		same = errLink == nil && target == fileInfo.Symlink
+	} else if same && c.contentDigest {
+		// the hash only samples large files, so the file is the
+		// same once the digest of its content matches too
+		log.Debugf("%s may already exist", pathToFile)
+		c.conflictsUnverified[i] = struct{}{}
+		return
+	}
+	if same {
+		log.Debugf("%s already exists", pathToFile)
+		c.emit(Event{Type: EventFileExists, FileIndex: i, File: fileInfo})
+		return
+	}
+	return c.applyConflictPolicy(i)
+}
+
+// applyConflictPolicy does what the policy says with the i-th file,
+// which exists with different content, returning whether it is skipped
+func (c *Client) applyConflictPolicy(i int) (skip bool, err error) {
+	fileInfo := c.FilesToTransfer[i]
+	pathToFile := path.Join(fileInfo.FolderRemote, fileInfo.Name)
+	policy := c.Options.ConflictPolicy
+	if policy == ConflictPrompt {
+		policy = c.promptConflict(pathToFile)
+	}
+	switch policy {
+	case ConflictSkip:
+		log.Debugf("skipping %s", pathToFile)
+		c.emit(Event{Type: EventFileSkipped, FileIndex: i, File: fileInfo})
+		skip = true
+	case ConflictRename:
+		newName := c.conflictFreeName(fileInfo.FolderRemote, fileInfo.Name)
+		log.Debugf("receiving %s as %s", pathToFile, newName)
+		c.emit(Event{Type: EventFileRenamed, FileIndex: i, File: fileInfo, NewName: newName})
+		c.FilesToTransfer[i].Name = newName
+		if c.journal != nil {
+			c.journal.Files[i].ReceivedAs = newName
+			c.saveJournal(true)
+		}
+	default:
+		log.Debugf("overwriting %s", pathToFile)
+		stat, errStat := os.Lstat(pathToFile)
+		if fileInfo.Symlink != "" && errStat == nil && !stat.IsDir() {
+			// symlinks are not created over existing files
+			err = os.Remove(pathToFile)
+		}
+	}
+	return
+}
+
+// promptConflict asks what to do with a file that already exists
+func (c *Client) promptConflict(pathToFile string) ConflictPolicy {
+	if c.Options.NoPrompt {
+		return ConflictOverwrite
+	}
+	for {
+		fmt.Fprintf(os.Stderr, "\r'%s' already exists. Overwrite, skip or rename? (o/s/r) ", pathToFile)
+		switch strings.ToLower(strings.TrimSpace(utils.GetInput(""))) {
+		case "o":
+			return ConflictOverwrite
+		case "s":
+			return ConflictSkip
+		case "r":
+			return ConflictRename
+		}
+	}
+}
@@ -2,12 +2,15 @@ package croc
 
 import (
 	"bytes"
+	"context"
+	"crypto/cipher"
 	"crypto/rand"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"io/fs"
 	"math"
 	"net"
 	"os"
@@ -22,7 +25,6 @@ import (
 	log "github.com/schollz/logger"
 	"github.com/schollz/pake/v2"
 	"github.com/schollz/peerdiscovery"
-	"github.com/schollz/progressbar/v3"
 	"github.com/tscholl2/siec"
 
 	"github.com/schollz/croc/v8/src/comm"
@@ -38,6 +40,31 @@ func init() {
 	log.SetLevel("debug")
 }
 
+// ErrCanceled is returned when a transfer is stopped by its context
+var ErrCanceled = errors.New("transfer canceled")
+
+// TransferError is returned when sending or receiving
+// the data of a file fails
+type TransferError struct {
+	// Op is the operation that failed, e.g. "read", "write" or "send"
+	Op string
+	// File is the name of the file being transferred, if any
+	File string
+	Err  error
+}
+
+func (e *TransferError) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("%s failed: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("%s '%s' failed: %v", e.Op, e.File, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *TransferError) Unwrap() error {
+	return e.Err
+}
+
 // Debug toggles debug mode
 func Debug(debug bool) {
 	if debug {
@@ -64,6 +91,47 @@ type Options struct {
 	Ask            bool
 	SendingText    bool
 	NoCompress     bool
+	// NoMetadata keeps received files from taking the
+	// modification time, permissions and owner of the sent files
+	NoMetadata bool
+	// SymlinkPolicy is which symlinks are accepted when receiving,
+	// if empty only symlinks inside the receiving folder are accepted
+	SymlinkPolicy SymlinkPolicy
+	// ConflictPolicy is what to do when a received file already
+	// exists with different content, if empty it is overwritten
+	ConflictPolicy ConflictPolicy
+	// Archive is the path of a .tar, .tar.gz or .zip archive that the
+	// files are received into instead of the current directory,
+	// or "-" to write the archive to stdout
+	Archive string
+	// ArchiveFormat is the format of Archive, if empty it is
+	// taken from its extension or is a tar on stdout
+	ArchiveFormat ArchiveFormat
+	// Throttle limits the rate of the data sent or received, such as
+	// "5M" for 5 MB per second, if empty the rate is not limited
+	Throttle string
+	// Cipher is the cipher of the data, if empty it is chosen by
+	// whether the CPUs of both peers have AES instructions. Peers
+	// that can not choose a cipher always use AES-GCM.
+	Cipher crypt.Cipher
+	// RekeyChunks and RekeyBytes are how many chunks and bytes of the
+	// data the key of each data connection encrypts before it is
+	// replaced, if 0 the defaults of crypt.DefaultLimits are used
+	RekeyChunks int64
+	RekeyBytes  int64
+	// Verify makes both users confirm that the verification codes
+	// of the peers match before the files are sent
+	Verify bool
+	// ConfirmVerification asks the user whether the verification code
+	// matches that of the peer, if nil it is asked on the terminal
+	ConfirmVerification func(code string) bool `json:"-"`
+
+	// Observer receives the events of the transfer, if nil
+	// the transfer is shown as progress bars on stderr
+	Observer Observer `json:"-"`
+	// Sink receives the files instead of the current directory,
+	// unless they are written to stdout
+	Sink Sink `json:"-"`
 }
 
 // Client holds the state of the croc transfer
@@ -95,18 +163,101 @@ type Client struct {
 	TotalChunksTransfered int
 	chunkMap              map[uint64]struct{}
 
+	// verification of the content of the current file
+	contentDigest     bool
+	verifyOnly        bool
+	rerequest         bool
+	verifyChunkRanges []int64
+	verifyAttempts    int
+	digestchan        chan *FileDigest
+
+	// small files are sent together as a bundle, see bundle.go,
+	// and other files in a pipeline, see pipeline.go
+	pipelining        bool
+	pipeline          []PipelineFile
+	pipelineFiles     map[int]*pipelinedFile
+	pipelineDone      int
+	bundling          bool
+	bundle            []BundleFile
+	bundleEntry       int
+	bundlePos         int64
+	bundleFileOpen    bool
+	receiveAlone      map[int]struct{}
+	bundleSinkDigests map[int]*reorderWriter
+	batchDigestchan   chan []*FileDigest
+
+	// chunk size and streams, tuned by the recipient, see tuning.go
+	tuning    bool
+	tuner     *tuner
+	chunkSize int
+	streams   int
+
+	// compression of the chunks, see compression.go
+	compression compress.Algorithm
+	compressors []*chunkCompressor
+	// chunks are sent with their context, see chunk.go
+	chunkContext bool
+	// ciphers of the data sent and received over the data connections,
+	// with the keys of the version of the handshake, see handshake.go
+	sendAEAD         cipher.AEAD
+	receiveAEAD      cipher.AEAD
+	sendKey          []byte
+	receiveKey       []byte
+	sendStreams      map[int]*crypt.Stream
+	receiveStreams   map[int]*crypt.Stream
+	dataCipher       crypt.Cipher
+	handshakeVersion int
+
+	// verification of the peer by its users, see verify.go
+	verificationCode string
+	peerVerify       bool
+	verified         bool
+	peerVerified     bool
+	// verifyDeadline ends the transfer if the peer does not confirm in time
+	verifyDeadline <-chan time.Time
+
+	// journal of the received files, used to resume
+	journal *journal
+	// files already checked for existing files in their place
+	conflictsChecked map[int]struct{}
+	// files whose existing copy has the same hash, but whose
+	// content is not verified yet, see checkConflict
+	conflictsUnverified map[int]struct{}
+
 	// tcp connections
 	conn []*comm.Comm
 
-	bar             *progressbar.ProgressBar
-	longestFilename int
-	firstSend       bool
+	// ctx is done when the transfer is stopped
+	ctx context.Context
+	// throttle limits the rate of the data connections
+	throttle *throttle
+
+	observer  Observer
+	firstSend bool
 
 	mutex       *sync.Mutex
-	fread       *os.File
-	numfinished int
+	source      fs.FS
+	stream      io.Reader
+	streamSent  bool
+	streamEnded bool
+	streamSize  int64
 	quit        chan bool
+	errchan     chan error
+	// errorShared is set once the peer knows why the transfer
+	// ends, as the error was sent to it or came from it
+	errorShared bool
 	finishedNum int
+
+	// files are received into sink, if it is set, instead of the
+	// current directory. The digest of the current file is computed
+	// in order by sinkDigest as it is written to sinkFile.
+	sink       Sink
+	sinkFile   SinkFile
+	sinkDigest *reorderWriter
+	stdout     io.Writer
+
+	// archive the files are received into with Options.Archive
+	archive *archiveSink
 }
 
 // Chunk contains information about the
@@ -118,15 +269,24 @@ type Chunk struct {
 
 // FileInfo registers the information about the file
 type FileInfo struct {
-	Name         string    `json:"n,omitempty"`
-	FolderRemote string    `json:"fr,omitempty"`
-	FolderSource string    `json:"fs,omitempty"`
-	Hash         []byte    `json:"h,omitempty"`
-	Size         int64     `json:"s,omitempty"`
-	ModTime      time.Time `json:"m,omitempty"`
-	IsCompressed bool      `json:"c,omitempty"`
-	IsEncrypted  bool      `json:"e,omitempty"`
-	Symlink      string    `json:"sy,omitempty"`
+	Name         string      `json:"n,omitempty"`
+	FolderRemote string      `json:"fr,omitempty"`
+	FolderSource string      `json:"fs,omitempty"`
+	Hash         []byte      `json:"h,omitempty"`
+	Size         int64       `json:"s,omitempty"`
+	ModTime      time.Time   `json:"m,omitempty"`
+	Mode         os.FileMode `json:"md,omitempty"`
+	UID          int         `json:"u,omitempty"`
+	GID          int         `json:"g,omitempty"`
+	IsCompressed bool        `json:"c,omitempty"`
+	IsEncrypted  bool        `json:"e,omitempty"`
+	Symlink      string      `json:"sy,omitempty"`
+	// IsDir is set for a directory, which is listed to recipients
+	// that do not create directories only if it is empty
+	IsDir bool `json:"d,omitempty"`
+	// IsStream is set for a file whose length is not known until
+	// a chunk marks its end, Size is not used
+	IsStream bool `json:"st,omitempty"`
 }
 
 // RemoteFileRequest requests specific bytes
@@ -134,6 +294,25 @@ type RemoteFileRequest struct {
 	CurrentFileChunkRanges    []int64
 	FilesToTransferCurrentNum int
 	MachineID                 string
+	// VerifyOnly requests only the digest of the file,
+	// as the recipient seems to have it already
+	VerifyOnly bool
+	// Bundle requests the files in it as a single stream,
+	// instead of the current file
+	Bundle []BundleFile
+	// Pipeline requests the files in it to be sent at once,
+	// instead of the current file
+	Pipeline []PipelineFile
+	// ChunkSize and Streams request the size of the chunks of
+	// the files that are requested whole and the number of data
+	// connections that send them, if 0 the defaults are used
+	ChunkSize int
+	Streams   int
+	// Compression is the algorithm chosen from those of the sender,
+	// if empty the chunks are compressed as a whole with flate
+	Compression compress.Algorithm
+	// ChunkContext requests chunks with their context
+	ChunkContext bool
 }
 
 // SenderInfo lists the files to be transferred
@@ -143,12 +322,34 @@ type SenderInfo struct {
 	Ask             bool
 	SendingText     bool
 	NoCompress      bool
+	// ContentDigest is set when the sender sends the
+	// digest of each file after transferring it
+	ContentDigest bool
+	// Bundles is set when the sender can send bundles of files
+	Bundles bool
+	// Pipeline is set when the sender can send several files at once
+	Pipeline bool
+	// Tuning is set when the sender can send the chunk size
+	// and over the streams that the recipient requests
+	Tuning bool
+	// Compressions lists the compression algorithms that the sender
+	// can choose for each chunk, in order of preference
+	Compressions []compress.Algorithm
+	// ChunkContext is set when the sender can send the chunks with
+	// their file index and position as associated data
+	ChunkContext bool
 }
 
 // New establishes a new connection for transferring files between two instances.
 func New(ops Options) (c *Client, err error) {
 	c = new(Client)
 	c.FilesHasFinished = make(map[int]struct{})
+	c.conflictsChecked = make(map[int]struct{})
+	c.conflictsUnverified = make(map[int]struct{})
+	c.receiveAlone = make(map[int]struct{})
+	c.bundleSinkDigests = make(map[int]*reorderWriter)
+	c.ctx = context.Background()
+	c.stdout = os.Stdout
 
 	// setup basic info
 	c.Options = ops
@@ -160,6 +361,59 @@ func New(ops Options) (c *Client, err error) {
 		return
 	}
 
+	switch c.Options.SymlinkPolicy {
+	case "":
+		c.Options.SymlinkPolicy = SymlinkInside
+	case SymlinkInside, SymlinkRefuse, SymlinkAllow:
+	default:
+		err = fmt.Errorf("unknown symlink policy '%s'", c.Options.SymlinkPolicy)
+		return
+	}
+	switch c.Options.ConflictPolicy {
+	case "":
+		c.Options.ConflictPolicy = ConflictOverwrite
+	case ConflictOverwrite, ConflictSkip, ConflictRename, ConflictPrompt:
+	default:
+		err = fmt.Errorf("unknown conflict policy '%s'", c.Options.ConflictPolicy)
+		return
+	}
+	if c.Options.Archive != "" {
+		if c.Options.Sink != nil {
+			err = fmt.Errorf("can not receive into both an archive and a sink")
+			return
+		}
+		switch c.Options.ArchiveFormat {
+		case "":
+			var ok bool
+			if c.Options.ArchiveFormat, ok = archiveFormatOf(c.Options.Archive); !ok && c.Options.Archive == "-" {
+				c.Options.ArchiveFormat = ArchiveTar
+			} else if !ok {
+				err = fmt.Errorf("unknown archive format of '%s'", c.Options.Archive)
+				return
+			}
+		case ArchiveTar, ArchiveTarGz, ArchiveZip:
+		default:
+			err = fmt.Errorf("unknown archive format '%s'", c.Options.ArchiveFormat)
+			return
+		}
+	}
+
+	if c.Options.Cipher != "" && !supportsCipher(c.Options.Cipher) {
+		err = fmt.Errorf("unknown cipher '%s'", c.Options.Cipher)
+		return
+	}
+
+	if c.Options.RekeyChunks < 0 || c.Options.RekeyBytes < 0 {
+		err = fmt.Errorf("can not rekey after %d chunks or %d bytes", c.Options.RekeyChunks, c.Options.RekeyBytes)
+		return
+	}
+
+	c.throttle = new(throttle)
+	if err = c.SetThrottle(c.Options.Throttle); err != nil {
+		err = fmt.Errorf("unknown throttle '%s'", c.Options.Throttle)
+		return
+	}
+
 	c.conn = make([]*comm.Comm, 16)
 
 	// initialize pake
@@ -172,6 +426,11 @@ func New(ops Options) (c *Client, err error) {
 		return
 	}
 
+	c.observer = c.Options.Observer
+	if c.observer == nil {
+		c.observer = newProgressBarObserver(c)
+	}
+
 	c.mutex = &sync.Mutex{}
 	return
 }
@@ -180,51 +439,79 @@ func New(ops Options) (c *Client, err error) {
 type TransferOptions struct {
 	PathToFiles      []string
 	KeepPathInRemote bool
+	// Source is where PathToFiles are read from, if nil they are
+	// paths on disk. Paths in Source are slash separated as in fs.FS,
+	// and symlinks are sent if it has Lstat and ReadLink methods.
+	Source fs.FS
+	// Stream is sent after the files as it is read, without knowing
+	// its length beforehand. It is named StreamName, if set.
+	Stream     io.Reader
+	StreamName string
 }
 
 func (c *Client) sendCollectFiles(options TransferOptions) (err error) {
+	c.source = options.Source
+	if c.source == nil {
+		c.source = osSource{}
+	}
 	c.FilesToTransfer = make([]FileInfo, len(options.PathToFiles))
-	totalFilesSize := int64(0)
 	for i, pathToFile := range options.PathToFiles {
 		var fstats os.FileInfo
 		var fullPath string
-		fullPath, err = filepath.Abs(pathToFile)
-		if err != nil {
-			return
-		}
-		fullPath = filepath.Clean(fullPath)
 		var folderName string
-		folderName, _ = filepath.Split(fullPath)
+		if options.Source != nil {
+			if !fs.ValidPath(pathToFile) {
+				err = fmt.Errorf("invalid path '%s'", pathToFile)
+				return
+			}
+			fullPath = pathToFile
+			folderName = path.Dir(pathToFile)
+		} else {
+			fullPath, err = filepath.Abs(pathToFile)
+			if err != nil {
+				return
+			}
+			fullPath = filepath.Clean(fullPath)
+			folderName, _ = filepath.Split(fullPath)
+		}
 
-		fstats, err = os.Lstat(fullPath)
+		fstats, err = lstatSource(c.source, fullPath)
 		if err != nil {
 			return
 		}
-		if len(fstats.Name()) > c.longestFilename {
-			c.longestFilename = len(fstats.Name())
-		}
 		c.FilesToTransfer[i] = FileInfo{
 			Name:         fstats.Name(),
 			FolderRemote: ".",
 			FolderSource: folderName,
 			Size:         fstats.Size(),
 			ModTime:      fstats.ModTime(),
+			Mode:         fstats.Mode().Perm(),
+		}
+		c.FilesToTransfer[i].UID, c.FilesToTransfer[i].GID = fileOwner(fstats)
+		c.FilesToTransfer[i].IsCompressed = isCompressedName(fstats.Name())
+		if fstats.IsDir() {
+			log.Debugf("%s is directory", fstats.Name())
+			c.FilesToTransfer[i].IsDir = true
+			c.FilesToTransfer[i].Size = 0
 		}
 		if fstats.Mode()&os.ModeSymlink != 0 {
 			log.Debugf("%s is symlink", fstats.Name())
-			c.FilesToTransfer[i].Symlink, err = os.Readlink(pathToFile)
+			c.FilesToTransfer[i].Symlink, err = readLinkSource(c.source, fullPath)
 			if err != nil {
 				log.Debugf("error getting symlink: %s", err.Error())
 			}
 			log.Debugf("%+v", c.FilesToTransfer[i])
 		}
 
-		c.FilesToTransfer[i].Hash, err = utils.HashFile(fullPath)
-		totalFilesSize += fstats.Size()
-		if err != nil {
-			return
+		if !c.FilesToTransfer[i].IsDir {
+			c.FilesToTransfer[i].Hash, err = hashSource(c.source, fullPath)
+			if err != nil {
+				return
+			}
 		}
-		if options.KeepPathInRemote {
+		if options.KeepPathInRemote && options.Source != nil {
+			c.FilesToTransfer[i].FolderRemote = folderName
+		} else if options.KeepPathInRemote {
 			var curFolder string
 			curFolder, err = os.Getwd()
 			if err != nil {
@@ -247,28 +534,29 @@ func (c *Client) sendCollectFiles(options TransferOptions) (err error) {
 		}
 		log.Debugf("file %d info: %+v", i, c.FilesToTransfer[i])
 	}
-	log.Debugf("longestFilename: %+v", c.longestFilename)
-	fname := fmt.Sprintf("%d files", len(c.FilesToTransfer))
-	if len(c.FilesToTransfer) == 1 {
-		fname = fmt.Sprintf("'%s'", c.FilesToTransfer[0].Name)
-	}
-	if strings.HasPrefix(fname, "'croc-stdin-") {
-		fname = "'stdin'"
-		if c.Options.SendingText {
-			fname = "'text'"
+	if options.Stream != nil {
+		c.stream = options.Stream
+		name := options.StreamName
+		if name == "" {
+			name = defaultStreamName
 		}
+		c.FilesToTransfer = append(c.FilesToTransfer, FileInfo{
+			Name:         name,
+			FolderRemote: ".",
+			ModTime:      time.Now(),
+			IsStream:     true,
+		})
 	}
-
-	fmt.Fprintf(os.Stderr, "Sending %s (%s)\n", fname, utils.ByteCountDecimal(totalFilesSize))
+	c.emit(Event{Type: EventManifest})
 	return
 }
 
-func (c *Client) setupLocalRelay() {
+func (c *Client) setupLocalRelay() (err error) {
 	// setup the relay locally
 	firstPort, _ := strconv.Atoi(c.Options.RelayPorts[0])
 	openPorts := utils.FindOpenPorts("localhost", firstPort, len(c.Options.RelayPorts))
 	if len(openPorts) < len(c.Options.RelayPorts) {
-		panic("not enough open ports to run local relay")
+		return fmt.Errorf("not enough open ports to run local relay")
 	}
 	for i, port := range openPorts {
 		c.Options.RelayPorts[i] = fmt.Sprint(port)
@@ -279,12 +567,14 @@ func (c *Client) setupLocalRelay() {
 			if c.Options.Debug {
 				debugString = "debug"
 			}
-			err := tcp.Run(debugString, portStr, c.Options.RelayPassword, strings.Join(c.Options.RelayPorts[1:], ","))
+			err := tcp.RunContext(c.ctx, debugString, portStr, c.Options.RelayPassword, strings.Join(c.Options.RelayPorts[1:], ","))
 			if err != nil {
-				panic(err)
+				// the transfer can still happen over the public relay
+				log.Debugf("local relay on %s stopped: %v", portStr, err)
 			}
 		}(port)
 	}
+	return
 }
 
 func (c *Client) broadcastOnLocalNetwork(useipv6 bool) {
@@ -294,6 +584,7 @@ func (c *Client) broadcastOnLocalNetwork(useipv6 bool) {
 		Payload:   []byte("croc" + c.Options.RelayPorts[0]),
 		Delay:     20 * time.Millisecond,
 		TimeLimit: 30 * time.Second,
+		StopChan:  c.stopChan(),
 	}
 	if useipv6 {
 		settings.IPVersion = peerdiscovery.IPv6
@@ -320,8 +611,12 @@ func (c *Client) transferOverLocalRelay(options TransferOptions, errchan chan<-
 		return
 	}
 	log.Debugf("local connection established: %+v", conn)
+	release := c.guardConn(conn)
 	for {
-		data, _ := conn.Receive()
+		data, errConn := conn.Receive()
+		if errConn != nil && c.ctx.Err() != nil {
+			return
+		}
 		if bytes.Equal(data, []byte("handshake")) {
 			break
 		} else if bytes.Equal(data, []byte{1}) {
@@ -330,7 +625,8 @@ func (c *Client) transferOverLocalRelay(options TransferOptions, errchan chan<-
 			log.Debugf("instead of handshake got: %s", data)
 		}
 	}
-	c.conn[0] = conn
+	release()
+	c.setConn(0, conn)
 	log.Debug("exchanged header message")
 	c.Options.RelayAddress = "localhost"
 	c.Options.RelayPorts = strings.Split(banner, ",")
@@ -344,22 +640,30 @@ func (c *Client) transferOverLocalRelay(options TransferOptions, errchan chan<-
 
 // Send will send the specified file
 func (c *Client) Send(options TransferOptions) (err error) {
+	return c.SendContext(context.Background(), options)
+}
+
+// SendContext will send the specified file, the transfer is stopped
+// and ErrCanceled returned once ctx is done
+func (c *Client) SendContext(ctx context.Context, options TransferOptions) (err error) {
+	defer c.emitResult(&err)
+	var cancel context.CancelFunc
+	c.ctx, cancel = context.WithCancel(ctx)
+	defer cancel()
+	go c.closeConnections()
+	err = c.send(options)
+	if err != nil && ctx.Err() != nil {
+		err = fmt.Errorf("%w: %v", ErrCanceled, ctx.Err())
+	}
+	return
+}
+
+func (c *Client) send(options TransferOptions) (err error) {
 	err = c.sendCollectFiles(options)
 	if err != nil {
 		return
 	}
-	flags := &strings.Builder{}
-	if c.Options.RelayAddress != models.DEFAULT_RELAY {
-		flags.WriteString("--relay " + c.Options.RelayAddress + " ")
-	}
-	if c.Options.RelayPassword != models.DEFAULT_PASSPHRASE {
-		flags.WriteString("--pass " + c.Options.RelayPassword + " ")
-	}
-	fmt.Fprintf(os.Stderr, "Code is: %[1]s\nOn the other computer run\n\ncroc %[2]s%[1]s\n", c.Options.SharedSecret, flags.String())
-	if c.Options.Ask {
-		machid, _ := machineid.ID()
-		fmt.Fprintf(os.Stderr, "\rYour machine ID is '%s'\n", machid)
-	}
+	c.emit(Event{Type: EventCodeReady, Code: c.Options.SharedSecret})
 	// // c.spinner.Suffix = " waiting for recipient..."
 	// c.spinner.Start()
 	// create channel for quitting
@@ -369,7 +673,10 @@ func (c *Client) Send(options TransferOptions) (err error) {
 	if !c.Options.DisableLocal {
 		// add two things to the error channel
 		errchan = make(chan error, 2)
-		c.setupLocalRelay()
+		err = c.setupLocalRelay()
+		if err != nil {
+			return
+		}
 		// broadcast on ipv4
 		go c.broadcastOnLocalNetwork(false)
 		// broadcast on ipv6
@@ -381,6 +688,8 @@ func (c *Client) Send(options TransferOptions) (err error) {
 		go func() {
 			var ipaddr, banner string
 			var conn *comm.Comm
+			// the error is its own, as send may return before it is done
+			var err error
 			durations := []time.Duration{100 * time.Millisecond, 5 * time.Second}
 			for i, address := range []string{c.Options.RelayAddress6, c.Options.RelayAddress} {
 				if address == "" {
@@ -414,11 +723,16 @@ func (c *Client) Send(options TransferOptions) (err error) {
 			}
 			log.Debugf("banner: %s", banner)
 			log.Debugf("connection established: %+v", conn)
+			release := c.guardConn(conn)
 			for {
 				log.Debug("waiting for bytes")
 				data, errConn := conn.Receive()
 				if errConn != nil {
 					log.Debugf("[%+v] had error: %s", conn, errConn.Error())
+					if c.ctx.Err() != nil {
+						errchan <- c.ctx.Err()
+						return
+					}
 				}
 				if bytes.Equal(data, []byte("ips?")) {
 					// recipient wants to try to connect to local ips
@@ -450,7 +764,8 @@ func (c *Client) Send(options TransferOptions) (err error) {
 				}
 			}
 
-			c.conn[0] = conn
+			release()
+			c.setConn(0, conn)
 			c.Options.RelayPorts = strings.Split(banner, ",")
 			if c.Options.NoMultiplexing {
 				log.Debug("no multiplexing")
@@ -462,7 +777,11 @@ func (c *Client) Send(options TransferOptions) (err error) {
 		}()
 	}
 
-	err = <-errchan
+	select {
+	case err = <-errchan:
+	case <-c.ctx.Done():
+		return c.ctx.Err()
+	}
 	if err == nil {
 		// return if no error
 		return
@@ -476,14 +795,37 @@ func (c *Client) Send(options TransferOptions) (err error) {
 		if strings.Contains(err.Error(), "refusing files") || strings.Contains(err.Error(), "EOF") || strings.Contains(err.Error(), "bad password") {
 			errchan <- err
 		}
-		err = <-errchan
+		select {
+		case err = <-errchan:
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		}
 	}
 	return err
 }
 
 // Receive will receive a file
 func (c *Client) Receive() (err error) {
-	fmt.Fprintf(os.Stderr, "connecting...")
+	return c.ReceiveContext(context.Background())
+}
+
+// ReceiveContext will receive a file, the transfer is stopped
+// and ErrCanceled returned once ctx is done
+func (c *Client) ReceiveContext(ctx context.Context) (err error) {
+	defer c.emitResult(&err)
+	var cancel context.CancelFunc
+	c.ctx, cancel = context.WithCancel(ctx)
+	defer cancel()
+	go c.closeConnections()
+	err = c.receive()
+	if err != nil && ctx.Err() != nil {
+		err = fmt.Errorf("%w: %v", ErrCanceled, ctx.Err())
+	}
+	return
+}
+
+func (c *Client) receive() (err error) {
+	c.emit(Event{Type: EventConnecting})
 	// recipient will look for peers first
 	// and continue if it doesn't find any within 100 ms
 	usingLocal := false
@@ -504,6 +846,7 @@ func (c *Client) Receive() (err error) {
 				Payload:   []byte("ok"),
 				Delay:     20 * time.Millisecond,
 				TimeLimit: 200 * time.Millisecond,
+				StopChan:  c.stopChan(),
 			})
 			if err1 == nil && len(ipv4discoveries) > 0 {
 				dmux.Lock()
@@ -520,6 +863,7 @@ func (c *Client) Receive() (err error) {
 				Delay:     20 * time.Millisecond,
 				TimeLimit: 200 * time.Millisecond,
 				IPVersion: peerdiscovery.IPv6,
+				StopChan:  c.stopChan(),
 			})
 			if err1 == nil && len(ipv6discoveries) > 0 {
 				dmux.Lock()
@@ -574,12 +918,20 @@ func (c *Client) Receive() (err error) {
 		log.Debugf("got host '%v' and port '%v'", host, port)
 		address = net.JoinHostPort(host, port)
 		log.Debugf("trying connection to %s", address)
-		c.conn[0], banner, c.ExternalIP, err = tcp.ConnectToTCPServer(address, c.Options.RelayPassword, c.Options.SharedSecret[:3], durations[i])
+		var conn *comm.Comm
+		conn, banner, c.ExternalIP, err = tcp.ConnectToTCPServer(address, c.Options.RelayPassword, c.Options.SharedSecret[:3], durations[i])
 		if err == nil {
+			c.setConn(0, conn)
 			c.Options.RelayAddress = address
 			break
 		}
 		log.Debugf("could not establish '%s'", address)
+		if c.ctx.Err() != nil {
+			return c.ctx.Err()
+		}
+	}
+	if err == nil && c.ctx.Err() != nil {
+		err = c.ctx.Err()
 	}
 	if err != nil {
 		err = fmt.Errorf("could not connect to %s: %w", c.Options.RelayAddress, err)
@@ -639,8 +991,7 @@ func (c *Client) Receive() (err error) {
 				c.Options.RelayAddress = serverTry
 				c.ExternalIP = externalIP
 				c.conn[0].Close()
-				c.conn[0] = nil
-				c.conn[0] = conn
+				c.setConn(0, conn)
 				break
 			}
 		}
@@ -655,15 +1006,70 @@ func (c *Client) Receive() (err error) {
 		c.Options.RelayPorts = []string{c.Options.RelayPorts[0]}
 	}
 	log.Debug("exchanged header message")
-	fmt.Fprintf(os.Stderr, "\rsecuring channel...")
 	return c.transfer(TransferOptions{})
 }
 
+// setConn sets the i-th connection of the transfer
+func (c *Client) setConn(i int, conn *comm.Comm) {
+	c.mutex.Lock()
+	c.conn[i] = conn
+	c.mutex.Unlock()
+}
+
+// closeConnections closes every connection once the transfer's context is done
+func (c *Client) closeConnections() {
+	<-c.ctx.Done()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, conn := range c.conn {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+// guardConn closes a connection that is not yet part of the transfer
+// if the transfer's context is done before release is called
+func (c *Client) guardConn(conn *comm.Comm) (release func()) {
+	released := make(chan struct{})
+	go func() {
+		select {
+		case <-c.ctx.Done():
+			conn.Close()
+		case <-released:
+		}
+	}()
+	return func() { close(released) }
+}
+
+// stopChan returns a channel that is closed once the transfer's context is done
+func (c *Client) stopChan() chan struct{} {
+	stop := make(chan struct{})
+	go func() {
+		<-c.ctx.Done()
+		close(stop)
+	}()
+	return stop
+}
+
+// emitResult reports how the transfer ended
+func (c *Client) emitResult(err *error) {
+	if *err != nil {
+		c.emit(Event{Type: EventError, Err: *err})
+	} else {
+		c.emit(Event{Type: EventTransferDone})
+	}
+}
+
 func (c *Client) transfer(options TransferOptions) (err error) {
 	// connect to the server
 
-	// quit with c.quit <- true
+	// quit with close(c.quit)
 	c.quit = make(chan bool)
+	defer close(c.quit)
+	// errors from sending and receiving data end the transfer
+	c.errchan = make(chan error, 1)
+	c.emit(Event{Type: EventConnected, Address: c.Options.RelayAddress})
 
 	// if recipient, initialize with sending pake information
 	log.Debug("ready")
@@ -678,26 +1084,50 @@ func (c *Client) transfer(options TransferOptions) (err error) {
 	}
 
 	// listen for incoming messages and process them
+	incoming, incomingErr := c.receiveMessages()
 	for {
 		var data []byte
 		var done bool
-		data, err = c.conn[0].Receive()
-		if err != nil {
+		select {
+		case data = <-incoming:
+		case err = <-incomingErr:
 			log.Debugf("got error receiving: %v", err)
 			if !c.Step1ChannelSecured {
 				err = fmt.Errorf("could not secure channel")
 			}
+		case err = <-c.errchan:
+			log.Debugf("got error transferring data: %v", err)
+			c.sendError(err)
+		case <-c.verifyDeadline:
+			err = fmt.Errorf("peer did not confirm the verification code within %s", verificationTimeout)
+			c.sendError(err)
+		}
+		if err != nil {
 			break
 		}
 		done, err = c.processMessage(data)
 		if err != nil {
 			log.Debugf("got error processing: %v", err)
+			if c.Step1ChannelSecured && !c.errorShared {
+				err = c.transferError(err)
+				c.sendError(err)
+			}
 			break
 		}
 		if done {
 			break
 		}
 	}
+	if c.journal != nil {
+		if c.SuccessfulTransfer {
+			c.journal.remove()
+		} else {
+			// the data connections may still be writing to it
+			c.mutex.Lock()
+			c.saveJournal(true)
+			c.mutex.Unlock()
+		}
+	}
 	// purge errors that come from successful transfer
 	if c.SuccessfulTransfer {
 		if err != nil {
@@ -706,18 +1136,20 @@ func (c *Client) transfer(options TransferOptions) (err error) {
 		err = nil
 	}
 
-	if c.Options.Stdout && !c.Options.IsSender {
-		pathToFile := path.Join(
-			c.FilesToTransfer[c.FilesToTransferCurrentNum].FolderRemote,
-			c.FilesToTransfer[c.FilesToTransferCurrentNum].Name,
-		)
-		log.Debugf("pathToFile: %s", pathToFile)
-		// close if not closed already
-		c.CurrentFile.Close()
-		if err := os.Remove(pathToFile); err != nil {
-			log.Warnf("error removing %s: %v", pathToFile, err)
+	if c.sinkFile != nil {
+		// release any data connections waiting on the sink
+		c.sinkFile.Close()
+	}
+	if c.sinkDigest != nil {
+		c.sinkDigest.Close()
+	}
+	if c.archive != nil {
+		if errArchive := c.closeArchive(); errArchive != nil && err == nil {
+			err = errArchive
 		}
-		fmt.Print("\n")
+	}
+	if c.Options.SendingText && !c.Options.IsSender {
+		fmt.Fprint(c.stdout, "\n")
 	}
 	if err != nil && strings.Contains(err.Error(), "pake not successful") {
 		log.Debugf("pake error: %s", err.Error())
@@ -730,7 +1162,98 @@ func (c *Client) transfer(options TransferOptions) (err error) {
 	return
 }
 
+// receiveMessages reads the messages from the peer until the transfer quits
+func (c *Client) receiveMessages() (incoming chan []byte, incomingErr chan error) {
+	incoming = make(chan []byte)
+	incomingErr = make(chan error, 1)
+	go func() {
+		for {
+			data, err := c.conn[0].Receive()
+			if err != nil {
+				incomingErr <- err
+				return
+			}
+			select {
+			case incoming <- data:
+			case <-c.quit:
+				return
+			}
+		}
+	}()
+	return
+}
+
+// dataError ends the transfer with err, only the first error is kept
+func (c *Client) dataError(err error) {
+	select {
+	case c.errchan <- err:
+	default:
+	}
+}
+
+// transferError returns err as a TransferError of the current file
+func (c *Client) transferError(err error) error {
+	var transferErr *TransferError
+	if errors.As(err, &transferErr) {
+		return err
+	}
+	transferErr = &TransferError{Op: "receive", Err: err}
+	if c.Options.IsSender {
+		transferErr.Op = "send"
+	}
+	if c.FilesToTransferCurrentNum < len(c.FilesToTransfer) {
+		transferErr.File = c.currentFileName()
+	}
+	return transferErr
+}
+
+// succeed marks the transfer as successful, which the
+// data connections check once they are closed
+func (c *Client) succeed() {
+	c.mutex.Lock()
+	c.SuccessfulTransfer = true
+	c.mutex.Unlock()
+}
+
+// succeeded reports whether the transfer was successful
+func (c *Client) succeeded() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.SuccessfulTransfer
+}
+
+// sendError tells the peer why the transfer is ending
+func (c *Client) sendError(err error) {
+	c.errorShared = true
+	errSend := message.Send(c.conn[0], c.Key, message.Message{
+		Type:    "error",
+		Message: err.Error(),
+	})
+	if errSend != nil {
+		log.Debugf("could not send error to peer: %v", errSend)
+	}
+}
+
+// checkPath checks that a file can be written without leaving
+// the receiving folder, and tells the peer if it cannot
+func (c *Client) checkPath(pathToFile string) (err error) {
+	if c.Options.SymlinkPolicy == SymlinkAllow {
+		return
+	}
+	if err = checkInsideRoot(pathToFile); err != nil {
+		c.sendError(fmt.Errorf("refusing files: %w", err))
+	}
+	return
+}
+
+func (c *Client) currentFileName() string {
+	return c.FilesToTransfer[c.FilesToTransferCurrentNum].Name
+}
+
 func (c *Client) processMessageFileInfo(m message.Message) (done bool, err error) {
+	if !c.verificationDone() {
+		return true, fmt.Errorf("files were sent before the verification code was confirmed")
+	}
 	var senderInfo SenderInfo
 	err = json.Unmarshal(m.Bytes, &senderInfo)
 	if err != nil {
@@ -745,49 +1268,78 @@ func (c *Client) processMessageFileInfo(m message.Message) (done bool, err error
 	if c.Options.SendingText {
 		c.Options.Stdout = true
 	}
-	c.FilesToTransfer = senderInfo.FilesToTransfer
-	fname := fmt.Sprintf("%d files", len(c.FilesToTransfer))
-	if len(c.FilesToTransfer) == 1 {
-		fname = fmt.Sprintf("'%s'", c.FilesToTransfer[0].Name)
+	c.sink = c.Options.Sink
+	if c.Options.Stdout {
+		c.sink = stdoutSink{w: c.stdout}
 	}
-	totalSize := int64(0)
+	c.contentDigest = senderInfo.ContentDigest
+	c.FilesToTransfer = senderInfo.FilesToTransfer
+	c.bundling = senderInfo.Bundles && c.contentDigest && shouldBundle(c.FilesToTransfer)
+	c.pipelining = senderInfo.Pipeline && c.contentDigest
+	c.tuning = senderInfo.Tuning
+	c.compression = chooseCompression(senderInfo.Compressions)
+	c.chunkContext = senderInfo.ChunkContext
 	for i, fi := range c.FilesToTransfer {
-		totalSize += fi.Size
-		if len(fi.Name) > c.longestFilename {
-			c.longestFilename = len(fi.Name)
-		}
-		if strings.HasPrefix(fi.Name, "croc-stdin-") {
-			c.FilesToTransfer[i].Name, err = utils.RandomFileName()
+		if strings.HasPrefix(fi.Name, "croc-stdin-") && c.sink == nil {
+			var fname string
+			fname, err = utils.RandomFileName()
 			if err != nil {
 				return
 			}
+			// the name is relative to the current directory
+			c.FilesToTransfer[i].Name = filepath.Base(fname)
 		}
 	}
-	// c.spinner.Stop()
-	if strings.HasPrefix(fname, "'croc-stdin") {
-		fname = "'stdin'"
-		if c.Options.SendingText {
-			fname = "'text'"
-		}
+	if err = validateManifest(c.FilesToTransfer, c.Options.SymlinkPolicy); err != nil {
+		log.Debugf("refusing manifest: %v", err)
+		c.sendError(fmt.Errorf("refusing files: %w", err))
+		return true, err
 	}
-	if !c.Options.NoPrompt || c.Options.Ask || senderInfo.Ask {
-		if c.Options.Ask || senderInfo.Ask {
+	if senderInfo.Ask {
+		c.Options.Ask = true
+	}
+	c.emit(Event{Type: EventManifest})
+	if !c.Options.NoPrompt || c.Options.Ask {
+		fname, totalSize := describeFiles(c.FilesToTransfer, c.Options.SendingText)
+		if c.Options.Ask {
 			machID, _ := machineid.ID()
 			fmt.Fprintf(os.Stderr, "\rYour machine id is '%s'.\nAccept %s (%s) from '%s'? (y/n) ", machID, fname, utils.ByteCountDecimal(totalSize), senderInfo.MachineID)
 		} else {
 			fmt.Fprintf(os.Stderr, "\rAccept %s (%s)? (y/n) ", fname, utils.ByteCountDecimal(totalSize))
 		}
 		if strings.ToLower(strings.TrimSpace(utils.GetInput(""))) != "y" {
-			err = message.Send(c.conn[0], c.Key, message.Message{
-				Type:    "error",
-				Message: "refusing files",
-			})
+			c.sendError(fmt.Errorf("refusing files"))
 			return true, fmt.Errorf("refused files")
 		}
-	} else {
-		fmt.Fprintf(os.Stderr, "\rReceiving %s (%s) \n", fname, utils.ByteCountDecimal(totalSize))
 	}
-	fmt.Fprintf(os.Stderr, "\nReceiving (<-%s)\n", c.ExternalIPConnected)
+
+	if c.Options.Archive != "" && !c.Options.Stdout {
+		if err = c.openArchive(); err != nil {
+			c.sendError(fmt.Errorf("could not receive files: %w", err))
+			return true, err
+		}
+	}
+	if c.sink == nil {
+		c.journal = loadJournal(c.FilesToTransfer)
+		for i := range c.FilesToTransfer {
+			// keep receiving files that were renamed under their new name
+			if receivedAs := c.journal.Files[i].ReceivedAs; receivedAs != "" && !strings.ContainsAny(receivedAs, `/\`) {
+				c.FilesToTransfer[i].Name = receivedAs
+			}
+			fi := c.FilesToTransfer[i]
+			if !c.journal.Files[i].Finished {
+				continue
+			}
+			stat, errStat := os.Stat(path.Join(fi.FolderRemote, fi.Name))
+			if errStat == nil && stat.Size() == fi.Size {
+				log.Debugf("%s was already received", fi.Name)
+				c.FilesHasFinished[i] = struct{}{}
+			} else {
+				c.journal.reset(i)
+			}
+		}
+		c.saveJournal(true)
+	}
 
 	log.Debug(c.FilesToTransfer)
 	c.Step2FileInfoTransfered = true
@@ -815,14 +1367,16 @@ func (c *Client) procesMessagePake(m message.Message) (err error) {
 	if c.Pake.IsVerified() {
 		if c.Options.IsSender {
 			log.Debug("generating salt")
-			salt := make([]byte, 8)
+			salt := make([]byte, 16)
 			if _, rerr := rand.Read(salt); err != nil {
 				log.Errorf("can't generate random numbers: %v", rerr)
 				return
 			}
 			err = message.Send(c.conn[0], c.Key, message.Message{
-				Type:  "salt",
-				Bytes: salt,
+				Type:    "salt",
+				Bytes:   salt,
+				Message: c.offeredCiphers(),
+				Num:     handshakeVersion,
 			})
 			if err != nil {
 				return
@@ -840,22 +1394,25 @@ func (c *Client) procesMessagePake(m message.Message) (err error) {
 				if c.Options.RelayAddress == "localhost" {
 					host = c.Options.RelayAddress
 				} else {
-					host, _, err = net.SplitHostPort(c.Options.RelayAddress)
-					if err != nil {
-						log.Errorf("bad relay address %s", c.Options.RelayAddress)
+					var errSplit error
+					host, _, errSplit = net.SplitHostPort(c.Options.RelayAddress)
+					if errSplit != nil {
+						c.dataError(fmt.Errorf("bad relay address %s: %w", c.Options.RelayAddress, errSplit))
 						return
 					}
 				}
 				server := net.JoinHostPort(host, c.Options.RelayPorts[j])
 				log.Debugf("connecting to %s", server)
-				c.conn[j+1], _, _, err = tcp.ConnectToTCPServer(
+				conn, _, _, errConn := tcp.ConnectToTCPServer(
 					server,
 					c.Options.RelayPassword,
 					fmt.Sprintf("%s-%d", utils.SHA256(c.Options.SharedSecret)[:7], j),
 				)
-				if err != nil {
-					panic(err)
+				if errConn != nil {
+					c.dataError(&TransferError{Op: "connect", Err: errConn})
+					return
 				}
+				c.setConn(j+1, conn)
 				log.Debugf("connected to %s", server)
 				if !c.Options.IsSender {
 					go c.receiveData(j)
@@ -869,29 +1426,68 @@ func (c *Client) procesMessagePake(m message.Message) (err error) {
 
 func (c *Client) processMessageSalt(m message.Message) (done bool, err error) {
 	log.Debug("received salt")
+	version := m.Num
+	offered := m.Message
+	chosen := crypt.AESGCM
 	if !c.Options.IsSender {
+		version = chooseHandshake(m.Num)
+		if version > handshakeLegacy {
+			if chosen, err = c.chooseCipher(offered); err != nil {
+				return true, err
+			}
+		}
 		log.Debug("sending salt back")
 		err = message.Send(c.conn[0], c.Key, message.Message{
-			Type:  "salt",
-			Bytes: m.Bytes,
+			Type:    "salt",
+			Bytes:   m.Bytes,
+			Message: string(chosen),
+			Num:     version,
 		})
+		if err != nil {
+			return true, err
+		}
+	} else if version < handshakeLegacy || version > handshakeVersion {
+		return true, fmt.Errorf("recipient chose unknown key derivation version %d", version)
+	} else {
+		offered = c.offeredCiphers()
+		if version > handshakeLegacy {
+			chosen = crypt.Cipher(m.Message)
+			if !strings.Contains(","+offered+",", ","+m.Message+",") {
+				return true, fmt.Errorf("recipient chose cipher '%s' that is not offered", m.Message)
+			}
+		}
 	}
 	log.Debugf("session key is verified, generating encryption with salt: %x", m.Bytes)
 	key, err := c.Pake.SessionKey()
 	if err != nil {
 		return true, err
 	}
-	c.Key, _, err = crypt.New(key, m.Bytes)
-	if err != nil {
+	if err = c.deriveKeys(key, m.Bytes, version, offered, chosen); err != nil {
+		return true, err
+	}
+	if err = c.checkVerification(version); err != nil {
+		c.sendError(err)
 		return true, err
 	}
 	log.Debugf("key = %+x", c.Key)
+	c.verificationCode, err = verificationCode(key, handshakeTranscript(m.Bytes, version, offered, string(chosen)))
+	if err != nil {
+		return true, err
+	}
+	c.emit(Event{Type: EventVerification, Code: c.verificationCode})
+	if c.Options.Verify {
+		err = message.Send(c.conn[0], c.Key, message.Message{Type: "verify"})
+		if err != nil {
+			return true, err
+		}
+	}
 	if c.Options.IsSender {
 		log.Debug("sending external IP")
 		err = message.Send(c.conn[0], c.Key, message.Message{
 			Type:    "externalip",
 			Message: c.ExternalIP,
 			Bytes:   m.Bytes,
+			Num:     handshakeVersion,
 		})
 	}
 	return
@@ -900,6 +1496,9 @@ func (c *Client) processMessageSalt(m message.Message) (done bool, err error) {
 func (c *Client) processExternalIP(m message.Message) (done bool, err error) {
 	log.Debugf("received external IP: %+v", m)
 	if !c.Options.IsSender {
+		if err = c.checkHandshake(m.Num); err != nil {
+			return true, err
+		}
 		err = message.Send(c.conn[0], c.Key, message.Message{
 			Type:    "externalip",
 			Message: c.ExternalIP,
@@ -914,11 +1513,12 @@ func (c *Client) processExternalIP(m message.Message) (done bool, err error) {
 	}
 	log.Debugf("connected as %s -> %s", c.ExternalIP, c.ExternalIPConnected)
 	c.Step1ChannelSecured = true
+	c.emit(Event{Type: EventPeerJoined, Address: c.ExternalIPConnected})
 	return
 }
 
 func (c *Client) processMessage(payload []byte) (done bool, err error) {
-	m, err := message.Decode(c.Key, payload)
+	m, err := message.DecodeLimit(c.Key, payload, c.messageLimit())
 	if err != nil {
 		err = fmt.Errorf("problem with decoding: %w", err)
 		log.Debug(err)
@@ -931,7 +1531,13 @@ func (c *Client) processMessage(payload []byte) (done bool, err error) {
 			Type: "finished",
 		})
 		done = true
-		c.SuccessfulTransfer = true
+		if c.Options.IsSender && c.stream != nil && !c.hasSentStream() {
+			// recipients without streams create it empty and finish
+			err = &TransferError{Op: "send", File: c.FilesToTransfer[len(c.FilesToTransfer)-1].Name,
+				Err: fmt.Errorf("recipient finished before the stream was sent, it may not support streams")}
+			return
+		}
+		c.succeed()
 		return
 	case "pake":
 		err = c.procesMessagePake(m)
@@ -943,9 +1549,13 @@ func (c *Client) processMessage(payload []byte) (done bool, err error) {
 		done, err = c.processMessageSalt(m)
 	case "externalip":
 		done, err = c.processExternalIP(m)
+	case "verify":
+		c.peerVerify = true
+	case "verified":
+		c.peerVerified = true
+		c.verifyDeadline = nil
 	case "error":
-		// c.spinner.Stop()
-		fmt.Print("\r")
+		c.errorShared = true
 		err = fmt.Errorf("peer error: %s", m.Message)
 		return true, err
 	case "fileinfo":
@@ -956,12 +1566,31 @@ func (c *Client) processMessage(payload []byte) (done bool, err error) {
 		if err != nil {
 			return
 		}
+		if err = c.checkBundle(remoteFile.Bundle); err != nil {
+			return
+		}
+		if err = c.senderInitializePipeline(remoteFile.Pipeline); err != nil {
+			return
+		}
+		if err = c.senderTune(remoteFile); err != nil {
+			return
+		}
+		if err = c.senderInitializeCompression(remoteFile.Compression); err != nil {
+			return
+		}
+		c.chunkContext = remoteFile.ChunkContext
 		c.FilesToTransferCurrentNum = remoteFile.FilesToTransferCurrentNum
+		c.verifyOnly = remoteFile.VerifyOnly
+		c.bundle = remoteFile.Bundle
 		c.CurrentFileChunkRanges = remoteFile.CurrentFileChunkRanges
 		c.CurrentFileChunks = utils.ChunkRangesToChunks(c.CurrentFileChunkRanges)
 		log.Debugf("current file chunks: %+v", c.CurrentFileChunks)
 		c.mutex.Lock()
-		c.chunkMap = make(map[uint64]struct{})
+		// a nil chunk map means that all chunks are requested
+		c.chunkMap = nil
+		if len(c.CurrentFileChunks) > 0 {
+			c.chunkMap = make(map[uint64]struct{})
+		}
 		for _, chunk := range c.CurrentFileChunks {
 			c.chunkMap[uint64(chunk)] = struct{}{}
 		}
@@ -971,27 +1600,44 @@ func (c *Client) processMessage(payload []byte) (done bool, err error) {
 		if c.Options.Ask {
 			fmt.Fprintf(os.Stderr, "Send to machine '%s'? (y/n) ", remoteFile.MachineID)
 			if strings.ToLower(strings.TrimSpace(utils.GetInput(""))) != "y" {
-				err = message.Send(c.conn[0], c.Key, message.Message{
-					Type:    "error",
-					Message: "refusing files",
-				})
+				c.sendError(fmt.Errorf("refusing files"))
 				done = true
 				err = fmt.Errorf("refused files")
 				return
 			}
 		}
 	case "close-sender":
-		c.bar.Finish()
 		log.Debug("close-sender received...")
 		c.Step4FileTransfer = false
 		c.Step3RecipientRequestFile = false
 		log.Debug("sending close-recipient")
-		err = message.Send(c.conn[0], c.Key, message.Message{
-			Type: "close-recipient",
+		if c.bundle != nil || c.pipeline != nil {
+			err = c.sendCloseDigests(<-c.batchDigestchan)
+			c.bundle = nil
+			c.pipeline = nil
+			break
+		}
+		c.emit(Event{
+			Type:      EventFileFinished,
+			FileIndex: c.FilesToTransferCurrentNum,
+			File:      c.FilesToTransfer[c.FilesToTransferCurrentNum],
 		})
+		var digest *FileDigest
+		if c.digestchan != nil {
+			digest = <-c.digestchan
+			c.digestchan = nil
+		}
+		err = c.sendCloseRecipient(digest)
 	case "close-recipient":
 		c.Step4FileTransfer = false
 		c.Step3RecipientRequestFile = false
+		if !c.Options.IsSender && c.pipeline != nil {
+			err = c.recipientVerifyPipeline(m.Bytes)
+		} else if !c.Options.IsSender && c.bundle != nil {
+			err = c.recipientVerifyBundle(m.Bytes)
+		} else if !c.Options.IsSender {
+			err = c.recipientVerifyFile(m.Bytes)
+		}
 	}
 	if err != nil {
 		log.Debugf("got error from processing message: %v", err)
@@ -1005,8 +1651,188 @@ func (c *Client) processMessage(payload []byte) (done bool, err error) {
 	return
 }
 
+// sendCloseRecipient tells the recipient that the current
+// file is sent along with the digest of its content
+func (c *Client) sendCloseRecipient(digest *FileDigest) (err error) {
+	m := message.Message{
+		Type: "close-recipient",
+	}
+	if digest != nil {
+		m.Bytes, err = json.Marshal(digest)
+		if err != nil {
+			return
+		}
+	}
+	return message.Send(c.conn[0], c.Key, m)
+}
+
+// recipientVerifyFile checks the current file against the digest
+// of its content from the sender. If they do not match the
+// differing chunks are requested again.
+func (c *Client) recipientVerifyFile(b []byte) (err error) {
+	fileInfo := c.FilesToTransfer[c.FilesToTransferCurrentNum]
+	pathToFile := path.Join(fileInfo.FolderRemote, fileInfo.Name)
+	if len(b) == 0 && c.sink != nil {
+		// sender does not send digests and the file is not on disk to check
+		c.FilesHasFinished[c.FilesToTransferCurrentNum] = struct{}{}
+		return c.finalizeFile(fileInfo)
+	} else if len(b) == 0 {
+		// sender does not send digests, the file is checked by its hash
+		// and requested again until it matches
+		fileHash, errHash := utils.HashFile(partialPath(pathToFile))
+		if errHash == nil && bytes.Equal(fileHash, fileInfo.Hash) {
+			c.verifyAttempts = 0
+			err = finishPartialFile(pathToFile)
+			return
+		}
+		c.verifyAttempts++
+		if c.verifyAttempts >= maxVerifyAttempts {
+			// the partial file is not resumed, as its chunks are not known
+			os.Remove(partialPath(pathToFile))
+			if c.journal != nil {
+				c.journal.reset(c.FilesToTransferCurrentNum)
+				c.saveJournal(true)
+			}
+			err = &TransferError{Op: "verify", File: fileInfo.Name,
+				Err: fmt.Errorf("hash does not match after %d attempts", c.verifyAttempts)}
+			c.sendError(err)
+		}
+		return
+	}
+	var remote FileDigest
+	err = json.Unmarshal(b, &remote)
+	if err != nil {
+		return
+	}
+	receivedPath := pathToFile
+	if utils.Exists(partialPath(pathToFile)) {
+		receivedPath = partialPath(pathToFile)
+	}
+	var local FileDigest
+	var errDigest error
+	if c.sink != nil {
+		local = c.sinkDigest.Sum()
+	} else {
+		local, errDigest = digestFile(receivedPath, fileInfo.Size)
+	}
+	if errDigest == nil && bytes.Equal(local.Hash, remote.Hash) {
+		log.Debugf("verified %s: %x", receivedPath, local.Hash)
+		if c.sink == nil {
+			if err = finishPartialFile(pathToFile); err != nil {
+				return
+			}
+		}
+		if _, ok := c.conflictsUnverified[c.FilesToTransferCurrentNum]; ok {
+			delete(c.conflictsUnverified, c.FilesToTransferCurrentNum)
+			log.Debugf("%s already exists", pathToFile)
+			c.emit(Event{Type: EventFileExists, FileIndex: c.FilesToTransferCurrentNum, File: fileInfo})
+		}
+		if c.verifyOnly {
+			c.emit(Event{
+				Type:      EventFileFinished,
+				FileIndex: c.FilesToTransferCurrentNum,
+				File:      fileInfo,
+			})
+		}
+		c.FilesHasFinished[c.FilesToTransferCurrentNum] = struct{}{}
+		if err = c.finalizeFile(fileInfo); err != nil {
+			return
+		}
+		if c.journal != nil {
+			c.journal.finish(c.FilesToTransferCurrentNum)
+			c.saveJournal(true)
+		}
+		c.verifyOnly = false
+		c.rerequest = false
+		c.verifyAttempts = 0
+		return
+	}
+	if errDigest != nil {
+		log.Debugf("could not digest %s: %v", receivedPath, errDigest)
+	}
+	if _, ok := c.conflictsUnverified[c.FilesToTransferCurrentNum]; ok && c.verifyOnly {
+		// the existing file only had the same hash, so it is a conflict
+		delete(c.conflictsUnverified, c.FilesToTransferCurrentNum)
+		var skip bool
+		if skip, err = c.applyConflictPolicy(c.FilesToTransferCurrentNum); err != nil {
+			return
+		}
+		if skip {
+			c.FilesHasFinished[c.FilesToTransferCurrentNum] = struct{}{}
+		}
+		if skip || c.FilesToTransfer[c.FilesToTransferCurrentNum].Name != fileInfo.Name {
+			// the file is skipped or received in full under its new name
+			c.verifyOnly = false
+			c.rerequest = false
+			return
+		}
+	}
+	if !c.verifyOnly {
+		c.verifyAttempts++
+	}
+	if c.verifyAttempts >= maxVerifyAttempts {
+		err = &TransferError{Op: "verify", File: fileInfo.Name,
+			Err: fmt.Errorf("content does not match after %d attempts", c.verifyAttempts)}
+		c.sendError(err)
+		return
+	}
+	if fileInfo.IsStream || c.sink != nil {
+		// a stream can not be read again and a sink is not read back
+		err = fmt.Errorf("content of %s does not match", fileInfo.Name)
+		c.sendError(err)
+		return
+	}
+	c.verifyChunkRanges = mismatchedChunkRanges(local, remote, fileInfo.Size)
+	log.Debugf("content of %s does not match, requesting chunks %+v", receivedPath, c.verifyChunkRanges)
+	c.verifyOnly = false
+	c.rerequest = true
+	return
+}
+
+// saveJournal flushes the current file and saves the journal,
+// unless it was saved recently and force is not set
+func (c *Client) saveJournal(force bool) {
+	if c.journal == nil || (!force && time.Since(c.journal.lastSaved) < journalSaveInterval) {
+		return
+	}
+	// the journal must not record data that is not on disk yet
+	if c.CurrentFile != nil {
+		c.CurrentFile.Sync()
+	}
+	for _, pf := range c.pipelineFiles {
+		if pf.file != nil {
+			pf.file.Sync()
+		}
+	}
+	if err := c.journal.save(); err != nil {
+		log.Debugf("could not save journal: %v", err)
+	}
+}
+
+// withoutDirectories returns the files without the directories that
+// have anything in them, which recipients that do not create
+// directories would replace with an empty file
+func withoutDirectories(files []FileInfo) (kept []FileInfo) {
+	full := make(map[string]struct{})
+	for _, fileInfo := range files {
+		for dir := path.Clean(fileInfo.FolderRemote); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			full[dir] = struct{}{}
+		}
+	}
+	for _, fileInfo := range files {
+		if _, ok := full[path.Join(fileInfo.FolderRemote, fileInfo.Name)]; ok && fileInfo.IsDir {
+			continue
+		}
+		kept = append(kept, fileInfo)
+	}
+	return
+}
+
 func (c *Client) updateIfSenderChannelSecured() (err error) {
-	if c.Options.IsSender && c.Step1ChannelSecured && !c.Step2FileInfoTransfered {
+	if c.Options.IsSender && c.Step1ChannelSecured && !c.Step2FileInfoTransfered && c.verificationDone() {
+		if c.handshakeVersion < handshakeDirectories {
+			c.FilesToTransfer = withoutDirectories(c.FilesToTransfer)
+		}
 		var b []byte
 		machID, _ := machineid.ID()
 		b, err = json.Marshal(SenderInfo{
@@ -1015,6 +1841,12 @@ func (c *Client) updateIfSenderChannelSecured() (err error) {
 			Ask:             c.Options.Ask,
 			SendingText:     c.Options.SendingText,
 			NoCompress:      c.Options.NoCompress,
+			ContentDigest:   true,
+			Bundles:         true,
+			Pipeline:        true,
+			Tuning:          true,
+			Compressions:    compress.Algorithms,
+			ChunkContext:    true,
 		})
 		if err != nil {
 			log.Error(err)
@@ -1036,12 +1868,30 @@ func (c *Client) updateIfSenderChannelSecured() (err error) {
 func (c *Client) recipientInitializeFile() (err error) {
 	// start initiating the process to receive a new file
 	log.Debugf("working on file %d", c.FilesToTransferCurrentNum)
+	c.CurrentFileChunks = []int64{}
+	c.CurrentFileChunkRanges = []int64{}
+	c.streamEnded = false
+	if c.verifyOnly {
+		// the file is already here and only needs to be verified
+		return
+	}
+	if c.sink != nil {
+		return c.sinkInitializeFile()
+	}
 
-	// recipient sets the file
+	// recipient sets the file, which is received under a partial name
+	// and only takes its name once it is complete
 	pathToFile := path.Join(
 		c.FilesToTransfer[c.FilesToTransferCurrentNum].FolderRemote,
 		c.FilesToTransfer[c.FilesToTransferCurrentNum].Name,
 	)
+	pathToPartial := partialPath(pathToFile)
+	if err = c.checkPath(pathToFile); err != nil {
+		return
+	}
+	if err = c.checkPath(pathToPartial); err != nil {
+		return
+	}
 	folderForFile, _ := filepath.Split(pathToFile)
 	folderForFileBase := filepath.Base(folderForFile)
 	if folderForFileBase != "." && folderForFileBase != "" {
@@ -1049,38 +1899,50 @@ func (c *Client) recipientInitializeFile() (err error) {
 			log.Errorf("can't create %s: %v", folderForFile, err)
 		}
 	}
+	if c.rerequest && !utils.Exists(pathToPartial) {
+		// the file that did not match the sender's digest is repaired
+		// in a copy so that it stays whole until it does
+		if err = copyFile(pathToFile, pathToPartial); err != nil {
+			err = fmt.Errorf("could not copy %s: %w", pathToFile, err)
+			log.Error(err)
+			return
+		}
+	}
 	var errOpen error
 	c.CurrentFile, errOpen = os.OpenFile(
-		pathToFile,
+		pathToPartial,
 		os.O_WRONLY, 0666)
 	var truncate bool // default false
-	c.CurrentFileChunks = []int64{}
-	c.CurrentFileChunkRanges = []int64{}
 	if errOpen == nil {
 		stat, _ := c.CurrentFile.Stat()
 		truncate = stat.Size() != c.FilesToTransfer[c.FilesToTransferCurrentNum].Size
-		if truncate == false {
-			// recipient requests the file and chunks (if empty, then should receive all chunks)
-			// TODO: determine the missing chunks
-			c.CurrentFileChunkRanges = utils.MissingChunks(
-				pathToFile,
-				c.FilesToTransfer[c.FilesToTransferCurrentNum].Size,
-				models.TCP_BUFFER_SIZE/2,
-			)
+		// recipient requests the file and chunks (if empty, then should receive all chunks)
+		if !truncate && c.rerequest {
+			// request the chunks that did not match the sender's digest
+			c.CurrentFileChunkRanges = c.verifyChunkRanges
+		} else if c.journal != nil && !c.rerequest && !c.FilesToTransfer[c.FilesToTransferCurrentNum].IsStream {
+			// request the chunks the journal has not received yet,
+			// as long as they are still in the file
+			c.journal.limit(c.FilesToTransferCurrentNum, stat.Size())
+			c.CurrentFileChunkRanges = c.journal.missingChunkRanges(c.FilesToTransferCurrentNum)
 		}
 	} else {
-		c.CurrentFile, errOpen = os.Create(pathToFile)
+		c.CurrentFile, errOpen = os.Create(pathToPartial)
 		if errOpen != nil {
-			errOpen = fmt.Errorf("could not create %s: %w", pathToFile, errOpen)
+			errOpen = fmt.Errorf("could not create %s: %w", pathToPartial, errOpen)
 			log.Error(errOpen)
 			return errOpen
 		}
 		truncate = true
 	}
+	if c.journal != nil && len(utils.ChunkRangesToChunks(c.CurrentFileChunkRanges)) == 0 {
+		// all of the file is requested
+		c.journal.reset(c.FilesToTransferCurrentNum)
+	}
 	if truncate {
 		err := c.CurrentFile.Truncate(c.FilesToTransfer[c.FilesToTransferCurrentNum].Size)
 		if err != nil {
-			err = fmt.Errorf("could not truncate %s: %w", pathToFile, err)
+			err = fmt.Errorf("could not truncate %s: %w", pathToPartial, err)
 			log.Error(err)
 			return err
 		}
@@ -1096,30 +1958,75 @@ func (c *Client) recipientGetFileReady(finished bool) (err error) {
 			Type: "finished",
 		})
 		if err != nil {
-			panic(err)
+			return
 		}
-		c.SuccessfulTransfer = true
+		c.succeed()
 		c.FilesHasFinished[c.FilesToTransferCurrentNum] = struct{}{}
+		// directories last, deepest first, so that receiving into
+		// them does not change their modification times
+		for i := len(c.FilesToTransfer) - 1; i >= 0; i-- {
+			if c.FilesToTransfer[i].IsDir {
+				if err = c.finalizeFile(c.FilesToTransfer[i]); err != nil {
+					return
+				}
+			}
+		}
+		return
 	}
 
-	err = c.recipientInitializeFile()
-	if err != nil {
-		return
+	if c.pipeline != nil {
+		err = c.recipientInitializePipeline()
+		if err != nil {
+			return
+		}
+	} else if c.bundle != nil {
+		// the files of the bundle are created as it is received
+		c.CurrentFileChunks = []int64{}
+		c.CurrentFileChunkRanges = []int64{}
+		c.streamEnded = false
+		c.bundleEntry = 0
+		c.bundlePos = 0
+		c.bundleFileOpen = false
+	} else {
+		err = c.recipientInitializeFile()
+		if err != nil {
+			return
+		}
 	}
 
+	c.mutex.Lock()
 	c.TotalSent = 0
+	c.TotalChunksTransfered = 0
+	c.mutex.Unlock()
 	machID, _ := machineid.ID()
-	bRequest, _ := json.Marshal(RemoteFileRequest{
+	request := RemoteFileRequest{
 		CurrentFileChunkRanges:    c.CurrentFileChunkRanges,
 		FilesToTransferCurrentNum: c.FilesToTransferCurrentNum,
 		MachineID:                 machID,
-	})
+		VerifyOnly:                c.verifyOnly,
+		Bundle:                    c.bundle,
+		Pipeline:                  c.pipeline,
+		Compression:               c.compression,
+		ChunkContext:              c.chunkContext,
+	}
+	if c.tuning {
+		if c.tuner == nil {
+			c.tuner = newTuner(len(c.Options.RelayPorts))
+		}
+		request.ChunkSize, request.Streams = c.tuner.request()
+		c.chunkSize = request.ChunkSize
+		c.tuner.start()
+	}
+	bRequest, _ := json.Marshal(request)
 	log.Debug("converting to chunk range")
 	c.CurrentFileChunks = utils.ChunkRangesToChunks(c.CurrentFileChunkRanges)
 
-	if !finished {
-		// setup the progressbar
-		c.setBar()
+	if c.pipeline != nil {
+		log.Debugf("requesting %d files at once", len(c.pipeline))
+	} else if c.bundle != nil {
+		log.Debugf("requesting a bundle of %d files", len(c.bundle))
+	} else {
+		c.emitFileStarted()
 	}
 
 	log.Debugf("sending recipient ready with %d chunks", len(c.CurrentFileChunks))
@@ -1135,7 +2042,19 @@ func (c *Client) recipientGetFileReady(finished bool) (err error) {
 }
 
 func (c *Client) createEmptyFileAndFinish(fileInfo FileInfo, i int) (err error) {
+	if c.Options.Stdout {
+		// nothing to write
+		c.FilesHasFinished[i] = struct{}{}
+		return
+	}
 	log.Debugf("touching file with folder / name")
+	pathToFile := path.Join(fileInfo.FolderRemote, fileInfo.Name)
+	if c.sink != nil {
+		return c.sinkCreateEmptyFile(fileInfo, i)
+	}
+	if err = c.checkPath(pathToFile); err != nil {
+		return
+	}
 	if !utils.Exists(fileInfo.FolderRemote) {
 		err = os.MkdirAll(fileInfo.FolderRemote, os.ModePerm)
 		if err != nil {
@@ -1143,8 +2062,15 @@ func (c *Client) createEmptyFileAndFinish(fileInfo FileInfo, i int) (err error)
 			return
 		}
 	}
-	pathToFile := path.Join(fileInfo.FolderRemote, fileInfo.Name)
-	if fileInfo.Symlink != "" {
+	if fileInfo.IsDir {
+		log.Debug("creating directory")
+		// the metadata is applied once everything in it is received
+		err = os.MkdirAll(pathToFile, os.ModePerm)
+		if err == nil {
+			c.FilesHasFinished[i] = struct{}{}
+		}
+		return
+	} else if fileInfo.Symlink != "" {
 		log.Debug("creating symlink")
 		err = os.Symlink(fileInfo.Symlink, pathToFile)
 		if err != nil {
@@ -1158,28 +2084,47 @@ func (c *Client) createEmptyFileAndFinish(fileInfo FileInfo, i int) (err error)
 			return
 		}
 		emptyFile.Close()
+		c.applyMetadata(fileInfo)
 	}
-	// setup the progressbar
-	description := fmt.Sprintf("%-*s", c.longestFilename, c.FilesToTransfer[i].Name)
-	if len(c.FilesToTransfer) == 1 {
-		description = c.FilesToTransfer[i].Name
-	}
-	c.bar = progressbar.NewOptions64(1,
-		progressbar.OptionOnCompletion(func() {
-			c.fmtPrintUpdate()
-		}),
-		progressbar.OptionSetWidth(20),
-		progressbar.OptionSetDescription(description),
-		progressbar.OptionSetRenderBlankState(true),
-		progressbar.OptionShowBytes(true),
-		progressbar.OptionShowCount(),
-		progressbar.OptionSetWriter(os.Stderr),
-		progressbar.OptionSetVisibility(!c.Options.SendingText),
-	)
-	c.bar.Finish()
+	c.emit(Event{Type: EventFileStarted, FileIndex: i, File: fileInfo})
+	c.emit(Event{Type: EventFileFinished, FileIndex: i, File: fileInfo})
+	return
+}
+
+// finalizeFile finishes a file that is completely received
+func (c *Client) finalizeFile(fileInfo FileInfo) (err error) {
+	if c.sink != nil {
+		return c.sink.Finalize(path.Join(fileInfo.FolderRemote, fileInfo.Name), fileInfo)
+	}
+	c.applyMetadata(fileInfo)
 	return
 }
 
+// applyMetadata gives a received file the modification time and
+// permissions of the sent file and, when running as root, its owner
+func (c *Client) applyMetadata(fileInfo FileInfo) {
+	if c.Options.NoMetadata || fileInfo.Symlink != "" {
+		return
+	}
+	pathToFile := path.Join(fileInfo.FolderRemote, fileInfo.Name)
+	if os.Geteuid() == 0 && (fileInfo.UID != 0 || fileInfo.GID != 0) {
+		if err := os.Chown(pathToFile, fileInfo.UID, fileInfo.GID); err != nil {
+			log.Debugf("could not set owner of %s: %v", pathToFile, err)
+		}
+	}
+	// senders before the mode was sent leave it empty
+	if fileInfo.Mode != 0 {
+		if err := os.Chmod(pathToFile, fileInfo.Mode.Perm()); err != nil {
+			log.Debugf("could not set permissions of %s: %v", pathToFile, err)
+		}
+	}
+	if !fileInfo.ModTime.IsZero() {
+		if err := os.Chtimes(pathToFile, fileInfo.ModTime, fileInfo.ModTime); err != nil {
+			log.Debugf("could not set modification time of %s: %v", pathToFile, err)
+		}
+	}
+}
+
 func (c *Client) updateIfRecipientHasFileInfo() (err error) {
 	if !(!c.Options.IsSender && c.Step2FileInfoTransfered && !c.Step3RecipientRequestFile) {
 		return
@@ -1187,6 +2132,7 @@ func (c *Client) updateIfRecipientHasFileInfo() (err error) {
 	// find the next file to transfer and send that number
 	// if the files are the same size, then look for missing chunks
 	finished := true
+	var bundleSize int64
 
 	for i, fileInfo := range c.FilesToTransfer {
 		if _, ok := c.FilesHasFinished[i]; ok {
@@ -1196,8 +2142,38 @@ func (c *Client) updateIfRecipientHasFileInfo() (err error) {
 		if i < c.FilesToTransferCurrentNum {
 			continue
 		}
-		fileHash, errHash := utils.HashFile(path.Join(fileInfo.FolderRemote, fileInfo.Name))
-		if fileInfo.Size == 0 || fileInfo.Symlink != "" {
+		var fileHash []byte
+		errHash := os.ErrNotExist
+		if c.sink == nil {
+			// files received into a sink are not compared to files on disk
+			fileHash, errHash = utils.HashFile(path.Join(fileInfo.FolderRemote, fileInfo.Name))
+		}
+		if _, ok := c.conflictsChecked[i]; !ok && !fileInfo.IsDir && c.sink == nil {
+			c.conflictsChecked[i] = struct{}{}
+			var skip bool
+			skip, err = c.checkConflict(i, fileHash, errHash)
+			if err != nil {
+				return
+			}
+			if skip {
+				c.FilesHasFinished[i] = struct{}{}
+				continue
+			}
+			if c.FilesToTransfer[i].Name != fileInfo.Name {
+				fileInfo = c.FilesToTransfer[i]
+				fileHash, errHash = utils.HashFile(path.Join(fileInfo.FolderRemote, fileInfo.Name))
+			}
+		}
+		if (fileInfo.Size == 0 && !fileInfo.IsStream) || fileInfo.Symlink != "" || fileInfo.IsDir {
+			if c.bundle != nil {
+				// it is created when the bundle gets to it,
+				// to keep the order of the manifest
+				c.bundle = append(c.bundle, BundleFile{Index: i})
+				if len(c.bundle) < bundleMaxFiles {
+					continue
+				}
+				break
+			}
 			err = c.createEmptyFileAndFinish(fileInfo, i)
 			if err != nil {
 				return
@@ -1214,25 +2190,71 @@ func (c *Client) updateIfRecipientHasFileInfo() (err error) {
 			// probably can't find, its okay
 			log.Debug(errHash)
 		}
+		if c.contentDigest {
+			// the file is verified by the digest of its content, if it seems to
+			// be here already then only its digest is requested
+			verifyOnly := !c.rerequest && !fileInfo.IsStream &&
+				((errHash == nil && bytes.Equal(fileHash, fileInfo.Hash)) ||
+					(c.journal != nil && c.journal.complete(i)))
+			if c.bundleable(i) && c.pipeline == nil {
+				c.bundle = append(c.bundle, BundleFile{Index: i, VerifyOnly: verifyOnly})
+				if !verifyOnly {
+					bundleSize += fileInfo.Size
+				}
+				if len(c.bundle) < bundleMaxFiles && bundleSize < bundleMaxSize {
+					continue
+				}
+				break
+			} else if c.pipelineable(i) && !verifyOnly && c.bundle == nil {
+				c.pipeline = append(c.pipeline, PipelineFile{Index: i})
+				if len(c.pipeline) < pipelineMaxFiles {
+					continue
+				}
+				break
+			} else if c.bundle != nil || c.pipeline != nil {
+				// the file is sent on its own after the files sent together
+				break
+			}
+			finished = false
+			c.FilesToTransferCurrentNum = i
+			c.verifyOnly = verifyOnly
+			break
+		}
 		if errHash != nil || !bytes.Equal(fileHash, fileInfo.Hash) {
 			finished = false
 			c.FilesToTransferCurrentNum = i
 			break
 		}
-		// TODO: print out something about this file already existing
+		c.applyMetadata(fileInfo)
+		if c.journal != nil {
+			c.journal.finish(i)
+		}
+	}
+	if len(c.pipeline) == 1 {
+		// a single file is requested on its own
+		c.FilesToTransferCurrentNum = c.pipeline[0].Index
+		c.pipeline = nil
+		finished = false
+		c.verifyOnly = false
+	} else if c.pipeline != nil {
+		finished = false
+		c.FilesToTransferCurrentNum = c.pipeline[0].Index
+		c.verifyOnly = false
+	} else if c.bundle != nil {
+		finished = false
+		c.FilesToTransferCurrentNum = c.bundle[0].Index
+		c.verifyOnly = false
 	}
 	err = c.recipientGetFileReady(finished)
 	return
 }
 
-func (c *Client) fmtPrintUpdate() {
-	c.finishedNum++
-	if len(c.FilesToTransfer) > 1 {
-		fmt.Fprintf(os.Stderr, " %d/%d\n", c.finishedNum, len(c.FilesToTransfer))
+func (c *Client) updateState() (err error) {
+	err = c.updateIfVerifying()
+	if err != nil {
+		return
 	}
-}
 
-func (c *Client) updateState() (err error) {
 	err = c.updateIfSenderChannelSecured()
 	if err != nil {
 		return
@@ -1247,48 +2269,61 @@ func (c *Client) updateState() (err error) {
 		log.Debug("start sending data!")
 
 		if !c.firstSend {
-			fmt.Fprintf(os.Stderr, "\nSending (->%s)\n", c.ExternalIPConnected)
 			c.firstSend = true
 			// if there are empty files, show them as already have been transferred now
 			for i := range c.FilesToTransfer {
-				if c.FilesToTransfer[i].Size == 0 {
-					// setup the progressbar and takedown the progress bar for empty files
-					description := fmt.Sprintf("%-*s", c.longestFilename, c.FilesToTransfer[i].Name)
-					if len(c.FilesToTransfer) == 1 {
-						description = c.FilesToTransfer[i].Name
-					}
-					c.bar = progressbar.NewOptions64(1,
-						progressbar.OptionOnCompletion(func() {
-							c.fmtPrintUpdate()
-						}),
-						progressbar.OptionSetWidth(20),
-						progressbar.OptionSetDescription(description),
-						progressbar.OptionSetRenderBlankState(true),
-						progressbar.OptionShowBytes(true),
-						progressbar.OptionShowCount(),
-						progressbar.OptionSetWriter(os.Stderr),
-						progressbar.OptionSetVisibility(!c.Options.SendingText),
-					)
-					c.bar.Finish()
+				if c.FilesToTransfer[i].Size == 0 && !c.FilesToTransfer[i].IsDir && !c.FilesToTransfer[i].IsStream {
+					c.emit(Event{Type: EventFileStarted, FileIndex: i, File: c.FilesToTransfer[i]})
+					c.emit(Event{Type: EventFileFinished, FileIndex: i, File: c.FilesToTransfer[i]})
 				}
 			}
 		}
 		c.Step4FileTransfer = true
-		// setup the progressbar
-		c.setBar()
 		c.TotalSent = 0
+		if c.pipeline != nil {
+			log.Debugf("sending %d files at once", len(c.pipeline))
+			c.batchDigestchan = make(chan []*FileDigest, 1)
+			for i := 0; i < c.streams; i++ {
+				go c.sendPipelineData(i)
+			}
+			return
+		} else if c.bundle != nil {
+			log.Debugf("sending a bundle of %d files", len(c.bundle))
+			c.batchDigestchan = make(chan []*FileDigest, 1)
+			go c.sendBundle()
+			return
+		}
+		c.emitFileStarted()
 		log.Debug("beginning sending comms")
 		pathToFile := path.Join(
 			c.FilesToTransfer[c.FilesToTransferCurrentNum].FolderSource,
 			c.FilesToTransfer[c.FilesToTransferCurrentNum].Name,
 		)
 
-		c.fread, err = os.Open(pathToFile)
-		c.numfinished = 0
-		if err != nil {
+		if c.verifyOnly {
+			// recipient has the file already and only needs its digest
+			var digest FileDigest
+			digest, err = digestSource(c.source, pathToFile, c.FilesToTransfer[c.FilesToTransferCurrentNum].Size)
+			if err != nil {
+				return
+			}
+			c.emit(Event{
+				Type:      EventFileFinished,
+				FileIndex: c.FilesToTransferCurrentNum,
+				File:      c.FilesToTransfer[c.FilesToTransferCurrentNum],
+			})
+			c.Step4FileTransfer = false
+			c.Step3RecipientRequestFile = false
+			return c.sendCloseRecipient(&digest)
+		}
+
+		c.digestchan = make(chan *FileDigest, 1)
+		if c.FilesToTransfer[c.FilesToTransferCurrentNum].IsStream {
+			log.Debug("starting sending stream")
+			go c.sendStream()
 			return
 		}
-		for i := 0; i < len(c.Options.RelayPorts); i++ {
+		for i := 0; i < c.streams; i++ {
 			log.Debugf("starting sending over comm %d", i)
 			go c.sendData(i)
 		}
@@ -1296,35 +2331,23 @@ func (c *Client) updateState() (err error) {
 	return
 }
 
-func (c *Client) setBar() {
-	description := fmt.Sprintf("%-*s", c.longestFilename, c.FilesToTransfer[c.FilesToTransferCurrentNum].Name)
-	if len(c.FilesToTransfer) == 1 {
-		description = c.FilesToTransfer[c.FilesToTransferCurrentNum].Name
-	}
-	c.bar = progressbar.NewOptions64(
-		c.FilesToTransfer[c.FilesToTransferCurrentNum].Size,
-		progressbar.OptionOnCompletion(func() {
-			c.fmtPrintUpdate()
-		}),
-		progressbar.OptionSetWidth(20),
-		progressbar.OptionSetDescription(description),
-		progressbar.OptionSetRenderBlankState(true),
-		progressbar.OptionShowBytes(true),
-		progressbar.OptionShowCount(),
-		progressbar.OptionSetWriter(os.Stderr),
-		progressbar.OptionThrottle(100*time.Millisecond),
-		progressbar.OptionSetVisibility(!c.Options.SendingText),
-	)
+func (c *Client) emitFileStarted() {
+	bytesDone := int64(0)
 	byteToDo := int64(len(c.CurrentFileChunks) * models.TCP_BUFFER_SIZE / 2)
-	if byteToDo > 0 {
-		bytesDone := c.FilesToTransfer[c.FilesToTransferCurrentNum].Size - byteToDo
+	if c.verifyOnly {
+		bytesDone = c.FilesToTransfer[c.FilesToTransferCurrentNum].Size
+	} else if byteToDo > 0 {
+		bytesDone = c.FilesToTransfer[c.FilesToTransferCurrentNum].Size - byteToDo
 		log.Debug(byteToDo)
 		log.Debug(c.FilesToTransfer[c.FilesToTransferCurrentNum].Size)
 		log.Debug(bytesDone)
-		if bytesDone > 0 {
-			c.bar.Add64(bytesDone)
-		}
 	}
+	c.emit(Event{
+		Type:      EventFileStarted,
+		FileIndex: c.FilesToTransferCurrentNum,
+		File:      c.FilesToTransfer[c.FilesToTransferCurrentNum],
+		Bytes:     bytesDone,
+	})
 }
 
 func (c *Client) receiveData(i int) {
@@ -1332,128 +2355,271 @@ func (c *Client) receiveData(i int) {
 	for {
 		data, err := c.conn[i+1].Receive()
 		if err != nil {
-			break
+			if c.ctx.Err() == nil && !c.succeeded() {
+				c.dataError(&TransferError{Op: "receive", Err: err})
+			}
+			return
 		}
 		if bytes.Equal(data, []byte{1}) {
 			log.Debug("got ping")
 			continue
 		}
+		if c.throttle.wait(c.ctx, len(data)) != nil {
+			return
+		}
+		if c.tuner != nil {
+			c.tuner.add(len(data))
+		}
 
-		data, err = crypt.Decrypt(data, c.Key)
+		headerSize := 8
+		if c.pipeline != nil {
+			headerSize = 12
+		}
+		index, data, err := c.openChunk(i, data, headerSize)
 		if err != nil {
-			panic(err)
+			c.dataError(err)
+			return
 		}
-		if !c.Options.NoCompress {
-			data = compress.Decompress(data)
+		if c.pipeline != nil {
+			if err = c.receivePipelineData(data); err != nil {
+				c.dataError(err)
+				return
+			}
+			continue
 		}
 
 		// get position
+		if len(data) < 8 {
+			c.dataError(&TransferError{Op: "decode", File: c.currentFileName(), Err: fmt.Errorf("chunk too short")})
+			return
+		}
 		var position uint64
 		rbuf := bytes.NewReader(data[:8])
 		err = binary.Read(rbuf, binary.LittleEndian, &position)
 		if err != nil {
-			panic(err)
+			c.dataError(&TransferError{Op: "decode", File: c.currentFileName(), Err: err})
+			return
 		}
 		positionInt64 := int64(position)
 
-		c.mutex.Lock()
-		_, err = c.CurrentFile.WriteAt(data[8:], positionInt64)
-		c.mutex.Unlock()
-		if err != nil {
-			panic(err)
+		var received bool
+		if position&streamEnd != 0 {
+			// the stream ended and its length is known now
+			expected := c.FilesToTransferCurrentNum
+			if c.bundle != nil {
+				expected = c.bundle[0].Index
+			}
+			if err = checkChunkIndex(index, expected); err != nil {
+				c.dataError(err)
+				return
+			}
+			received = c.endStream(int64(position &^ streamEnd))
+		} else if c.bundle != nil {
+			if err = c.receiveBundleData(positionInt64, index, data[8:]); err != nil {
+				c.dataError(err)
+				return
+			}
+			received = c.addReceived(int64(len(data[8:])), 0)
+		} else {
+			if err = checkChunkIndex(index, c.FilesToTransferCurrentNum); err != nil {
+				c.dataError(err)
+				return
+			}
+			if err = c.writeReceived(data[8:], positionInt64); err != nil {
+				c.dataError(&TransferError{Op: "write", File: c.currentFileName(), Err: err})
+				return
+			}
+			c.emit(Event{
+				Type:      EventFileProgress,
+				FileIndex: c.FilesToTransferCurrentNum,
+				File:      c.FilesToTransfer[c.FilesToTransferCurrentNum],
+				Bytes:     int64(len(data[8:])),
+			})
+			received = c.addReceived(int64(len(data[8:])), 1)
 		}
-		c.bar.Add(len(data[8:]))
-		c.TotalSent += int64(len(data[8:]))
-		c.TotalChunksTransfered++
-		if c.TotalChunksTransfered == len(c.CurrentFileChunks) || c.TotalSent == c.FilesToTransfer[c.FilesToTransferCurrentNum].Size {
+		if received {
 			log.Debug("finished receiving!")
-			if err := c.CurrentFile.Close(); err != nil {
-				log.Errorf("error closing %s: %v", c.CurrentFile.Name(), err)
+			if c.bundle != nil {
+				err = c.receiveBundleEnd()
+			} else {
+				c.emit(Event{
+					Type:      EventFileFinished,
+					FileIndex: c.FilesToTransferCurrentNum,
+					File:      c.FilesToTransfer[c.FilesToTransferCurrentNum],
+				})
+				err = c.closeReceivedFile()
 			}
-			if c.Options.Stdout || c.Options.SendingText {
-				pathToFile := path.Join(
-					c.FilesToTransfer[c.FilesToTransferCurrentNum].FolderRemote,
-					c.FilesToTransfer[c.FilesToTransferCurrentNum].Name,
-				)
-				b, _ := ioutil.ReadFile(pathToFile)
-				fmt.Print(string(b))
+			if err != nil {
+				c.dataError(err)
+				return
+			}
+			if c.tuner != nil {
+				c.tuner.finish()
 			}
 			log.Debug("sending close-sender")
 			err = message.Send(c.conn[0], c.Key, message.Message{
 				Type: "close-sender",
 			})
 			if err != nil {
-				panic(err)
+				c.dataError(&TransferError{Op: "send", File: c.currentFileName(), Err: err})
+				return
 			}
 		}
 	}
 }
 
+// writeReceived writes data received at pos of the current file
+func (c *Client) writeReceived(data []byte, pos int64) (err error) {
+	if c.sink != nil {
+		// the sink may wait for the data before this, so it is not locked
+		return c.writeSink(data, pos)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, err = c.CurrentFile.WriteAt(data, pos)
+	if err == nil && c.journal != nil {
+		c.journal.add(c.FilesToTransferCurrentNum, pos, pos+int64(len(data)))
+		c.saveJournal(false)
+	}
+	return
+}
+
+// closeReceivedFile closes the current file once all of it is received
+func (c *Client) closeReceivedFile() (err error) {
+	if c.sink != nil {
+		c.mutex.Lock()
+		sinkFile := c.sinkFile
+		c.sinkFile = nil
+		c.mutex.Unlock()
+		if err = sinkFile.Close(); err != nil {
+			return &TransferError{Op: "write", File: c.currentFileName(), Err: err}
+		}
+		return
+	}
+	c.mutex.Lock()
+	if err := c.CurrentFile.Sync(); err != nil {
+		log.Debugf("error syncing %s: %v", c.CurrentFile.Name(), err)
+	}
+	c.saveJournal(true)
+	c.mutex.Unlock()
+	if err := c.CurrentFile.Close(); err != nil {
+		log.Errorf("error closing %s: %v", c.CurrentFile.Name(), err)
+	}
+	return
+}
+
+// sendChunk sends the data at pos over the i-th data connection
+func (c *Client) sendChunk(i, index int, pos uint64, data []byte) (err error) {
+	posByte := make([]byte, 8)
+	binary.LittleEndian.PutUint64(posByte, pos)
+	return c.sendChunkHeader(i, index, posByte, data)
+}
+
+// sendIndexedChunk sends the data at pos of the index-th file over
+// the i-th data connection, for files that are sent together
+func (c *Client) sendIndexedChunk(i, index int, pos uint64, data []byte) (err error) {
+	header := make([]byte, 12)
+	binary.LittleEndian.PutUint64(header, pos)
+	binary.LittleEndian.PutUint32(header[8:], uint32(index))
+	return c.sendChunkHeader(i, index, header, data)
+}
+
+func (c *Client) sendChunkHeader(i, index int, header []byte, data []byte) (err error) {
+	dataToSend, err := c.sealChunk(i, index, header, data)
+	if err != nil {
+		return &TransferError{Op: "encrypt", File: c.currentFileName(), Err: err}
+	}
+	if err = c.throttle.wait(c.ctx, len(dataToSend)); err != nil {
+		return
+	}
+	err = c.conn[i+1].Send(dataToSend)
+	if err != nil {
+		return &TransferError{Op: "send", File: c.currentFileName(), Err: err}
+	}
+	return
+}
+
 func (c *Client) sendData(i int) {
+	var digest *FileDigest
 	defer func() {
-		log.Debugf("finished with %d", i)
-		c.numfinished++
-		if c.numfinished == len(c.Options.RelayPorts) {
-			log.Debug("closing file")
-			if err := c.fread.Close(); err != nil {
-				log.Errorf("error closing file: %v", err)
-			}
+		if i == 0 {
+			c.digestchan <- digest
 		}
+		log.Debugf("finished with %d", i)
 	}()
+	digest, err := c.sendFile(i, c.FilesToTransferCurrentNum, c.chunkMap, c.chunkSizeOf(c.CurrentFileChunkRanges), false)
+	if err != nil && c.ctx.Err() == nil {
+		c.dataError(err)
+	}
+}
+
+// sendFile sends the chunks of the index-th file that the i-th data
+// connection sends and that are in chunkMap, or all of them if it is
+// nil. The first connection reads the whole file, so it returns the
+// digest of its content. If indexed the chunks carry the file index.
+func (c *Client) sendFile(i, index int, chunkMap map[uint64]struct{}, chunkSize int, indexed bool) (digest *FileDigest, err error) {
+	fileInfo := c.FilesToTransfer[index]
+	var d *digester
+	if i == 0 {
+		d = newDigester(fileInfo.Size)
+	}
+
+	// each sender reads the file on its own, as a source
+	// may not be able to read from more than one place at once
+	fread, err := c.source.Open(path.Join(fileInfo.FolderSource, fileInfo.Name))
+	if err != nil {
+		return nil, &TransferError{Op: "open", File: fileInfo.Name, Err: err}
+	}
+	defer fread.Close()
 
-	var readingPos int64
 	pos := uint64(0)
 	curi := float64(0)
 	for {
+		if err = c.ctx.Err(); err != nil {
+			return
+		}
 		// Read file
-		data := make([]byte, models.TCP_BUFFER_SIZE/2)
+		data := make([]byte, chunkSize)
 		// log.Debugf("%d trying to read", i)
-		n, errRead := c.fread.ReadAt(data, readingPos)
+		n, errRead := io.ReadFull(fread, data)
 		// log.Debugf("%d read %d bytes", i, n)
-		readingPos += int64(n)
+		if d != nil {
+			d.Write(data[:n])
+		}
 
-		if math.Mod(curi, float64(len(c.Options.RelayPorts))) == float64(i) {
+		// a file whose size is a multiple of the chunk size ends
+		// with an empty read, which is not sent
+		if n > 0 && math.Mod(curi, float64(c.streams)) == float64(i) {
 			// check to see if this is a chunk that the recipient wants
 			usableChunk := true
 			c.mutex.Lock()
-			if len(c.chunkMap) != 0 {
-				if _, ok := c.chunkMap[pos]; !ok {
+			if chunkMap != nil {
+				if _, ok := chunkMap[pos]; !ok {
 					usableChunk = false
 				} else {
-					delete(c.chunkMap, pos)
+					delete(chunkMap, pos)
 				}
 			}
 			c.mutex.Unlock()
 			if usableChunk {
 				// log.Debugf("sending chunk %d", pos)
-				posByte := make([]byte, 8)
-				binary.LittleEndian.PutUint64(posByte, pos)
-				var err error
-				var dataToSend []byte
-				if c.Options.NoCompress {
-					dataToSend, err = crypt.Encrypt(
-						append(posByte, data[:n]...),
-						c.Key,
-					)
+				if indexed {
+					err = c.sendIndexedChunk(i, index, pos, data[:n])
 				} else {
-
-					dataToSend, err = crypt.Encrypt(
-						compress.Compress(
-							append(posByte, data[:n]...),
-						),
-						c.Key,
-					)
-				}
-				if err != nil {
-					panic(err)
+					err = c.sendChunk(i, index, pos, data[:n])
 				}
-
-				err = c.conn[i+1].Send(dataToSend)
 				if err != nil {
-					panic(err)
+					return
 				}
-				c.bar.Add(n)
+				c.emit(Event{
+					Type:      EventFileProgress,
+					FileIndex: index,
+					File:      fileInfo,
+					Bytes:     int64(n),
+				})
+				c.mutex.Lock()
 				c.TotalSent += int64(n)
+				c.mutex.Unlock()
 				// time.Sleep(100 * time.Millisecond)
 			}
 		}
@@ -1462,10 +2628,14 @@ func (c *Client) sendData(i int) {
 		pos += uint64(n)
 
 		if errRead != nil {
-			if errRead == io.EOF {
-				break
+			if errRead == io.EOF || errRead == io.ErrUnexpectedEOF {
+				if d != nil {
+					sum := d.Sum()
+					digest = &sum
+				}
+				return
 			}
-			panic(errRead)
+			return nil, &TransferError{Op: "read", File: fileInfo.Name, Err: errRead}
 		}
 	}
 }
@@ -1,13 +1,35 @@
 package croc
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
 	"time"
 
+	"github.com/schollz/croc/v8/src/comm"
+	"github.com/schollz/croc/v8/src/compress"
+	"github.com/schollz/croc/v8/src/crypt"
+	"github.com/schollz/croc/v8/src/message"
 	"github.com/schollz/croc/v8/src/tcp"
+	"github.com/schollz/croc/v8/src/utils"
 	log "github.com/schollz/logger"
 	"github.com/stretchr/testify/assert"
 )
@@ -80,6 +102,79 @@ func TestCrocReadme(t *testing.T) {
 	wg.Wait()
 }
 
+func TestCrocObserver(t *testing.T) {
+	defer os.Remove("README.md")
+
+	var mutex sync.Mutex
+	events := make(map[bool]map[EventType]int)
+	observe := func(isSender bool) Observer {
+		events[isSender] = make(map[EventType]int)
+		return ObserverFunc(func(e Event) {
+			mutex.Lock()
+			events[isSender][e.Type]++
+			mutex.Unlock()
+		})
+	}
+
+	sender, err := New(Options{
+		IsSender:      true,
+		SharedSecret:  "test",
+		Debug:         true,
+		RelayAddress:  "localhost:8081",
+		RelayPorts:    []string{"8081"},
+		RelayPassword: "pass123",
+		NoPrompt:      true,
+		DisableLocal:  true,
+		Observer:      observe(true),
+	})
+	if err != nil {
+		panic(err)
+	}
+	receiver, err := New(Options{
+		IsSender:      false,
+		SharedSecret:  "test",
+		Debug:         true,
+		RelayAddress:  "localhost:8081",
+		RelayPassword: "pass123",
+		NoPrompt:      true,
+		DisableLocal:  true,
+		Observer:      observe(false),
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		err := sender.Send(TransferOptions{
+			PathToFiles: []string{"../../README.md"},
+		})
+		if err != nil {
+			t.Errorf("send failed: %v", err)
+		}
+		wg.Done()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	go func() {
+		err := receiver.Receive()
+		if err != nil {
+			t.Errorf("receive failed: %v", err)
+		}
+		wg.Done()
+	}()
+	wg.Wait()
+
+	for _, isSender := range []bool{true, false} {
+		for _, et := range []EventType{EventConnected, EventPeerJoined, EventManifest, EventFileStarted, EventFileProgress, EventFileFinished, EventTransferDone} {
+			assert.True(t, events[isSender][et] > 0, "sender=%v missing %s", isSender, et)
+		}
+		assert.Equal(t, 0, events[isSender][EventError])
+		assert.Equal(t, isSender, events[isSender][EventCodeReady] == 1)
+		assert.Equal(t, !isSender, events[isSender][EventConnecting] == 1)
+	}
+}
+
 func TestCrocLocal(t *testing.T) {
 	log.SetLevel("trace")
 	defer os.Remove("LICENSE")
@@ -180,3 +275,2074 @@ func TestCrocError(t *testing.T) {
 	assert.NotNil(t, err)
 
 }
+
+func TestCrocCancel(t *testing.T) {
+	sender, err := New(Options{
+		IsSender:      true,
+		SharedSecret:  "cancel-test",
+		Debug:         true,
+		RelayAddress:  "localhost:8081",
+		RelayPorts:    []string{"8481", "8482"},
+		RelayPassword: "pass123",
+		NoPrompt:      true,
+		DisableLocal:  false,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	err = sender.SendContext(ctx, TransferOptions{
+		PathToFiles: []string{"../../README.md"},
+	})
+	assert.True(t, errors.Is(err, ErrCanceled), "got %v", err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	// the local relay should be stopped
+	time.Sleep(100 * time.Millisecond)
+	for _, port := range sender.Options.RelayPorts {
+		ln, err := net.Listen("tcp", ":"+port)
+		assert.Nil(t, err)
+		if err == nil {
+			ln.Close()
+		}
+	}
+}
+
+func TestCrocDroppedConnection(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "dropped")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	if _, err = tmpfile.Write(make([]byte, 10000000)); err != nil {
+		panic(err)
+	}
+	tmpfile.Close()
+	_, fname := filepath.Split(tmpfile.Name())
+	defer os.Remove(fname)
+	defer os.Remove(partialPath(fname))
+
+	sender, err := New(Options{
+		IsSender:      true,
+		SharedSecret:  "dropped-test",
+		Debug:         true,
+		RelayAddress:  "localhost:8081",
+		RelayPorts:    []string{"8081"},
+		RelayPassword: "pass123",
+		NoPrompt:      true,
+		DisableLocal:  true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	var receiver *Client
+	var once sync.Once
+	receiver, err = New(Options{
+		IsSender:      false,
+		SharedSecret:  "dropped-test",
+		Debug:         true,
+		RelayAddress:  "localhost:8081",
+		RelayPassword: "pass123",
+		NoPrompt:      true,
+		DisableLocal:  true,
+		Observer: ObserverFunc(func(e Event) {
+			if e.Type == EventFileStarted {
+				// drop the data connections before any data arrives
+				once.Do(func() {
+					for _, conn := range receiver.conn[1:] {
+						if conn != nil {
+							conn.Close()
+						}
+					}
+				})
+			}
+		}),
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	var wg sync.WaitGroup
+	var sendErr, receiveErr error
+	wg.Add(2)
+	go func() {
+		sendErr = sender.Send(TransferOptions{
+			PathToFiles: []string{tmpfile.Name()},
+		})
+		wg.Done()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	go func() {
+		receiveErr = receiver.Receive()
+		wg.Done()
+	}()
+	wg.Wait()
+
+	os.Remove(journalPath(receiver.FilesToTransfer))
+
+	var transferErr *TransferError
+	assert.True(t, errors.As(receiveErr, &transferErr), "got %v", receiveErr)
+	assert.NotNil(t, sendErr)
+}
+
+func TestCrocLocalError(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "localerror")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	if _, err = tmpfile.WriteString("local error"); err != nil {
+		panic(err)
+	}
+	tmpfile.Close()
+	_, fname := filepath.Split(tmpfile.Name())
+	// the recipient can not create the file
+	assert.Nil(t, os.Mkdir(partialPath(fname), 0755))
+	defer os.Remove(partialPath(fname))
+
+	sender, err := New(Options{
+		IsSender:      true,
+		SharedSecret:  "localerror-test",
+		Debug:         true,
+		RelayAddress:  "localhost:8081",
+		RelayPorts:    []string{"8081"},
+		RelayPassword: "pass123",
+		NoPrompt:      true,
+		DisableLocal:  true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	receiver, err := New(Options{
+		IsSender:      false,
+		SharedSecret:  "localerror-test",
+		Debug:         true,
+		RelayAddress:  "localhost:8081",
+		RelayPassword: "pass123",
+		NoPrompt:      true,
+		DisableLocal:  true,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	var wg sync.WaitGroup
+	var sendErr, receiveErr error
+	wg.Add(2)
+	go func() {
+		sendErr = sender.Send(TransferOptions{
+			PathToFiles: []string{tmpfile.Name()},
+		})
+		wg.Done()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	go func() {
+		receiveErr = receiver.Receive()
+		wg.Done()
+	}()
+	wg.Wait()
+
+	os.Remove(journalPath(receiver.FilesToTransfer))
+
+	var transferErr *TransferError
+	assert.True(t, errors.As(receiveErr, &transferErr), "got %v", receiveErr)
+	if assert.NotNil(t, sendErr) {
+		assert.Contains(t, sendErr.Error(), "could not create")
+	}
+}
+
+func TestCrocResume(t *testing.T) {
+	content := make([]byte, 10000000)
+	rand.New(rand.NewSource(1)).Read(content)
+	tmpfile, err := ioutil.TempFile("", "resume")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	if _, err = tmpfile.Write(content); err != nil {
+		panic(err)
+	}
+	tmpfile.Close()
+	_, fname := filepath.Split(tmpfile.Name())
+	defer os.Remove(fname)
+
+	transfer := func(secret string, cancelAfter int64) (sender *Client, receiveErr error) {
+		sender, err := New(Options{
+			IsSender:      true,
+			SharedSecret:  secret,
+			Debug:         true,
+			RelayAddress:  "localhost:8081",
+			RelayPorts:    []string{"8081"},
+			RelayPassword: "pass123",
+			NoPrompt:      true,
+			DisableLocal:  true,
+		})
+		if err != nil {
+			panic(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var received int64
+		receiver, err := New(Options{
+			IsSender:      false,
+			SharedSecret:  secret,
+			Debug:         true,
+			RelayAddress:  "localhost:8081",
+			RelayPassword: "pass123",
+			NoPrompt:      true,
+			DisableLocal:  true,
+			Observer: ObserverFunc(func(e Event) {
+				if e.Type == EventFileProgress && cancelAfter > 0 {
+					if atomic.AddInt64(&received, e.Bytes) > cancelAfter {
+						cancel()
+					}
+				}
+			}),
+		})
+		if err != nil {
+			panic(err)
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			sender.Send(TransferOptions{
+				PathToFiles: []string{tmpfile.Name()},
+			})
+			wg.Done()
+		}()
+		time.Sleep(100 * time.Millisecond)
+		go func() {
+			receiveErr = receiver.ReceiveContext(ctx)
+			wg.Done()
+		}()
+		wg.Wait()
+		return
+	}
+
+	// interrupt the transfer halfway
+	_, err = transfer("resume-test", int64(len(content)/2))
+	assert.True(t, errors.Is(err, ErrCanceled), "got %v", err)
+	matches, _ := filepath.Glob(".croc-*.journal")
+	assert.Len(t, matches, 1)
+	// the incomplete file is only under its partial name
+	_, err = os.Stat(fname)
+	assert.True(t, os.IsNotExist(err))
+	assert.True(t, utils.Exists(partialPath(fname)))
+
+	// the next attempt only receives what is missing
+	sender, err := transfer("again-test", 0)
+	assert.Nil(t, err)
+	received, err := ioutil.ReadFile(fname)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(content, received))
+	assert.True(t, sender.TotalSent < int64(len(content)))
+	assert.True(t, sender.TotalSent > 0)
+	matches, _ = filepath.Glob(".croc-*.journal")
+	assert.Empty(t, matches)
+	assert.False(t, utils.Exists(partialPath(fname)))
+}
+
+func TestCrocVerifyContent(t *testing.T) {
+	content := make([]byte, 10000000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	tmpfile, err := ioutil.TempFile("", "verify")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	if _, err = tmpfile.Write(content); err != nil {
+		panic(err)
+	}
+	tmpfile.Close()
+
+	// the recipient has a copy that differs where the sampled hash does not look
+	_, fname := filepath.Split(tmpfile.Name())
+	defer os.Remove(fname)
+	corrupted := append([]byte{}, content...)
+	corrupted[len(corrupted)/4]++
+	if err = ioutil.WriteFile(fname, corrupted, 0644); err != nil {
+		panic(err)
+	}
+	hash1, _ := utils.HashFile(tmpfile.Name())
+	hash2, _ := utils.HashFile(fname)
+	assert.Equal(t, hash1, hash2)
+
+	sender, err := New(Options{
+		IsSender:      true,
+		SharedSecret:  "verify-test",
+		Debug:         true,
+		RelayAddress:  "localhost:8081",
+		RelayPorts:    []string{"8081"},
+		RelayPassword: "pass123",
+		NoPrompt:      true,
+		DisableLocal:  true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	receiver, err := New(Options{
+		IsSender:      false,
+		SharedSecret:  "verify-test",
+		Debug:         true,
+		RelayAddress:  "localhost:8081",
+		RelayPassword: "pass123",
+		NoPrompt:      true,
+		DisableLocal:  true,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		err := sender.Send(TransferOptions{
+			PathToFiles: []string{tmpfile.Name()},
+		})
+		if err != nil {
+			t.Errorf("send failed: %v", err)
+		}
+		wg.Done()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	go func() {
+		err := receiver.Receive()
+		if err != nil {
+			t.Errorf("receive failed: %v", err)
+		}
+		wg.Done()
+	}()
+	wg.Wait()
+
+	received, err := ioutil.ReadFile(fname)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(content, received))
+	// only the corrupted block is sent again
+	assert.True(t, sender.TotalSent < int64(len(content)))
+}
+
+func TestCrocStream(t *testing.T) {
+	content := make([]byte, 3000000)
+	rand.New(rand.NewSource(2)).Read(content)
+	defer os.Remove("stream-test.bin")
+
+	// the stream is written while it is sent
+	r, w := io.Pipe()
+	go func() {
+		for i := 0; i < len(content); i += 100000 {
+			w.Write(content[i : i+100000])
+			time.Sleep(10 * time.Millisecond)
+		}
+		w.Close()
+	}()
+
+	sender, err := New(Options{
+		IsSender:      true,
+		SharedSecret:  "stream-test",
+		Debug:         true,
+		RelayAddress:  "localhost:8081",
+		RelayPorts:    []string{"8081"},
+		RelayPassword: "pass123",
+		NoPrompt:      true,
+		DisableLocal:  true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	receiver, err := New(Options{
+		IsSender:      false,
+		SharedSecret:  "stream-test",
+		Debug:         true,
+		RelayAddress:  "localhost:8081",
+		RelayPassword: "pass123",
+		NoPrompt:      true,
+		DisableLocal:  true,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		err := sender.Send(TransferOptions{
+			Stream:     r,
+			StreamName: "stream-test.bin",
+		})
+		if err != nil {
+			t.Errorf("send failed: %v", err)
+		}
+		wg.Done()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	go func() {
+		err := receiver.Receive()
+		if err != nil {
+			t.Errorf("receive failed: %v", err)
+		}
+		wg.Done()
+	}()
+	wg.Wait()
+
+	assert.True(t, receiver.FilesToTransfer[0].IsStream)
+	received, err := ioutil.ReadFile("stream-test.bin")
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(content, received))
+}
+
+func TestCrocStdout(t *testing.T) {
+	content := make([]byte, 5000000)
+	rand.New(rand.NewSource(3)).Read(content)
+	tmpfile, err := ioutil.TempFile("", "stdout")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	if _, err = tmpfile.Write(content); err != nil {
+		panic(err)
+	}
+	tmpfile.Close()
+	_, fname := filepath.Split(tmpfile.Name())
+	before, _ := ioutil.ReadDir(".")
+
+	sender, err := New(Options{
+		IsSender:      true,
+		SharedSecret:  "stdout-test",
+		Debug:         true,
+		RelayAddress:  "localhost:8281",
+		RelayPorts:    []string{"8281", "8282", "8283"},
+		RelayPassword: "pass123",
+		NoPrompt:      true,
+		DisableLocal:  false,
+	})
+	if err != nil {
+		panic(err)
+	}
+	receiver, err := New(Options{
+		IsSender:      false,
+		SharedSecret:  "stdout-test",
+		Debug:         true,
+		RelayAddress:  "localhost:8281",
+		RelayPassword: "pass123",
+		Stdout:        true,
+		NoPrompt:      true,
+		DisableLocal:  false,
+	})
+	if err != nil {
+		panic(err)
+	}
+	var stdout bytes.Buffer
+	receiver.stdout = &stdout
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		err := sender.Send(TransferOptions{
+			PathToFiles: []string{tmpfile.Name()},
+		})
+		if err != nil {
+			t.Errorf("send failed: %v", err)
+		}
+		wg.Done()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	go func() {
+		err := receiver.Receive()
+		if err != nil {
+			t.Errorf("receive failed: %v", err)
+		}
+		wg.Done()
+	}()
+	wg.Wait()
+
+	assert.True(t, bytes.Equal(content, stdout.Bytes()))
+	// nothing is written to the working directory
+	after, _ := ioutil.ReadDir(".")
+	assert.Equal(t, len(before), len(after))
+	assert.False(t, utils.Exists(fname))
+}
+
+func TestReorderWriter(t *testing.T) {
+	var b bytes.Buffer
+	r := newReorderWriter(&b)
+	for _, w := range []struct {
+		off  int64
+		data string
+	}{{6, "world"}, {5, " "}, {6, "world"}, {0, "hello"}, {5, " "}} {
+		n, err := r.WriteAt([]byte(w.data), w.off)
+		assert.Nil(t, err)
+		assert.Equal(t, len(w.data), n)
+	}
+	assert.Equal(t, "hello world", b.String())
+	digest := newStreamDigester()
+	digest.Write([]byte("hello world"))
+	assert.Equal(t, digest.Sum().Hash, r.Sum().Hash)
+
+	r.Close()
+	_, err := r.WriteAt([]byte("!"), 11)
+	assert.Equal(t, errSinkClosed, err)
+}
+
+// memSink receives files into memory
+type memSink struct {
+	sync.Mutex
+	files     map[string]*memSinkFile
+	dirs      map[string]bool
+	symlinks  map[string]string
+	finalized map[string]FileInfo
+}
+
+type memSinkFile struct {
+	sync.Mutex
+	data   []byte
+	closed bool
+}
+
+func newMemSink() *memSink {
+	return &memSink{
+		files:     make(map[string]*memSinkFile),
+		dirs:      make(map[string]bool),
+		symlinks:  make(map[string]string),
+		finalized: make(map[string]FileInfo),
+	}
+}
+
+func (s *memSink) Create(name string, fileInfo FileInfo) (SinkFile, error) {
+	s.Lock()
+	defer s.Unlock()
+	f := &memSinkFile{}
+	s.files[name] = f
+	return f, nil
+}
+
+func (s *memSink) Mkdir(name string, fileInfo FileInfo) error {
+	s.Lock()
+	defer s.Unlock()
+	s.dirs[name] = true
+	return nil
+}
+
+func (s *memSink) Symlink(name string, fileInfo FileInfo) error {
+	s.Lock()
+	defer s.Unlock()
+	s.symlinks[name] = fileInfo.Symlink
+	return nil
+}
+
+func (s *memSink) Finalize(name string, fileInfo FileInfo) error {
+	s.Lock()
+	defer s.Unlock()
+	s.finalized[name] = fileInfo
+	return nil
+}
+
+func (f *memSinkFile) WriteAt(p []byte, off int64) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if end := off + int64(len(p)); end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	copy(f.data[off:], p)
+	return len(p), nil
+}
+
+func (f *memSinkFile) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestCrocSourceAndSink(t *testing.T) {
+	content := make([]byte, 300000)
+	rand.New(rand.NewSource(4)).Read(content)
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	source := fstest.MapFS{
+		"docs":           &fstest.MapFile{Mode: os.ModeDir | 0755, ModTime: modTime},
+		"docs/a.bin":     &fstest.MapFile{Data: content, Mode: 0600, ModTime: modTime},
+		"docs/empty.txt": &fstest.MapFile{Mode: 0644},
+		"docs/sub":       &fstest.MapFile{Mode: os.ModeDir | 0755},
+		"b.txt":          &fstest.MapFile{Data: []byte("hello, sink"), Mode: 0644},
+	}
+	before, _ := ioutil.ReadDir(".")
+
+	sender, err := New(Options{
+		IsSender:      true,
+		SharedSecret:  "fsys-test",
+		Debug:         true,
+		RelayAddress:  "localhost:8081",
+		RelayPorts:    []string{"8081"},
+		RelayPassword: "pass123",
+		NoPrompt:      true,
+		DisableLocal:  true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	sink := newMemSink()
+	receiver, err := New(Options{
+		IsSender:      false,
+		SharedSecret:  "fsys-test",
+		Debug:         true,
+		RelayAddress:  "localhost:8081",
+		RelayPassword: "pass123",
+		NoPrompt:      true,
+		DisableLocal:  true,
+		Sink:          sink,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		err := sender.Send(TransferOptions{
+			Source:           source,
+			PathToFiles:      []string{"docs", "docs/a.bin", "docs/empty.txt", "docs/sub", "b.txt"},
+			KeepPathInRemote: true,
+		})
+		if err != nil {
+			t.Errorf("send failed: %v", err)
+		}
+		wg.Done()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	go func() {
+		err := receiver.Receive()
+		if err != nil {
+			t.Errorf("receive failed: %v", err)
+		}
+		wg.Done()
+	}()
+	wg.Wait()
+
+	assert.True(t, sink.dirs["docs"])
+	assert.True(t, sink.dirs["docs/sub"])
+	if assert.Contains(t, sink.files, "docs/a.bin") {
+		assert.True(t, bytes.Equal(content, sink.files["docs/a.bin"].data))
+		assert.True(t, sink.files["docs/a.bin"].closed)
+	}
+	if assert.Contains(t, sink.files, "b.txt") {
+		assert.Equal(t, "hello, sink", string(sink.files["b.txt"].data))
+	}
+	if assert.Contains(t, sink.files, "docs/empty.txt") {
+		assert.Empty(t, sink.files["docs/empty.txt"].data)
+	}
+	assert.Len(t, sink.finalized, 5)
+	assert.Equal(t, os.FileMode(0600), sink.finalized["docs/a.bin"].Mode)
+	assert.True(t, modTime.Equal(sink.finalized["docs/a.bin"].ModTime))
+	assert.True(t, modTime.Equal(sink.finalized["docs"].ModTime))
+	// nothing is written to the working directory
+	after, _ := ioutil.ReadDir(".")
+	assert.Equal(t, len(before), len(after))
+	assert.False(t, utils.Exists("docs"))
+}
+
+func TestCrocArchive(t *testing.T) {
+	content := make([]byte, 300000)
+	rand.New(rand.NewSource(5)).Read(content)
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	source := fstest.MapFS{
+		"docs":       &fstest.MapFile{Mode: os.ModeDir | 0750, ModTime: modTime},
+		"docs/a.bin": &fstest.MapFile{Data: content, Mode: 0600, ModTime: modTime},
+		"docs/b.txt": &fstest.MapFile{Mode: 0644, ModTime: modTime},
+	}
+	type entry struct {
+		name    string
+		mode    os.FileMode
+		modTime time.Time
+		data    []byte
+	}
+	expected := []entry{
+		{"docs/", os.ModeDir | 0750, modTime, nil},
+		{"docs/a.bin", 0600, modTime, content},
+		{"docs/b.txt", 0644, modTime, nil},
+		{"stream.txt", 0, time.Time{}, []byte("streamed")},
+	}
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, archive := range []string{filepath.Join(dir, "files.zip"), "-"} {
+		secret := "zip-archive-test"
+		if archive == "-" {
+			secret = "tgz-archive-test"
+		}
+		sender, err := New(Options{
+			IsSender:      true,
+			SharedSecret:  secret,
+			Debug:         true,
+			RelayAddress:  "localhost:8081",
+			RelayPorts:    []string{"8081"},
+			RelayPassword: "pass123",
+			NoPrompt:      true,
+			DisableLocal:  true,
+		})
+		if err != nil {
+			panic(err)
+		}
+		receiver, err := New(Options{
+			IsSender:      false,
+			SharedSecret:  secret,
+			Debug:         true,
+			RelayAddress:  "localhost:8081",
+			RelayPassword: "pass123",
+			NoPrompt:      true,
+			DisableLocal:  true,
+			Archive:       archive,
+			ArchiveFormat: map[string]ArchiveFormat{"-": ArchiveTarGz}[archive],
+		})
+		if err != nil {
+			panic(err)
+		}
+		var stdout bytes.Buffer
+		receiver.stdout = &stdout
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			err := sender.Send(TransferOptions{
+				Source:           source,
+				PathToFiles:      []string{"docs", "docs/a.bin", "docs/b.txt"},
+				KeepPathInRemote: true,
+				Stream:           bytes.NewBufferString("streamed"),
+				StreamName:       "stream.txt",
+			})
+			if err != nil {
+				t.Errorf("send failed: %v", err)
+			}
+			wg.Done()
+		}()
+		time.Sleep(100 * time.Millisecond)
+		go func() {
+			err := receiver.Receive()
+			if err != nil {
+				t.Errorf("receive failed: %v", err)
+			}
+			wg.Done()
+		}()
+		wg.Wait()
+
+		var entries []entry
+		if archive == "-" {
+			gr, err := gzip.NewReader(&stdout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tr := tar.NewReader(gr)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				data, _ := ioutil.ReadAll(tr)
+				entries = append(entries, entry{hdr.Name, hdr.FileInfo().Mode(), hdr.ModTime, data})
+			}
+		} else {
+			zr, err := zip.OpenReader(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range zr.File {
+				r, _ := f.Open()
+				data, _ := ioutil.ReadAll(r)
+				r.Close()
+				entries = append(entries, entry{f.Name, f.Mode(), f.Modified, data})
+			}
+			zr.Close()
+		}
+		if assert.Len(t, entries, len(expected)) {
+			for i, e := range expected {
+				assert.Equal(t, e.name, entries[i].name)
+				assert.True(t, bytes.Equal(e.data, entries[i].data))
+				if e.mode != 0 {
+					assert.Equal(t, e.mode, entries[i].mode)
+					assert.True(t, e.modTime.Equal(entries[i].modTime), "%s: %s", e.name, entries[i].modTime)
+				}
+			}
+		}
+	}
+	assert.False(t, utils.Exists("docs"))
+}
+
+func TestCrocBundle(t *testing.T) {
+	rnd := rand.New(rand.NewSource(6))
+	source := fstest.MapFS{
+		"bdir":           &fstest.MapFile{Mode: os.ModeDir | 0755},
+		"bdir/empty.txt": &fstest.MapFile{Mode: 0644},
+		"bdir/sub":       &fstest.MapFile{Mode: os.ModeDir | 0755},
+	}
+	paths := []string{"bdir", "bdir/empty.txt"}
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("bdir/f%02d.txt", i)
+		if i >= 15 {
+			name = fmt.Sprintf("bdir/sub/f%02d.txt", i)
+		}
+		if i == 15 {
+			paths = append(paths, "bdir/sub")
+		}
+		data := make([]byte, 1+rnd.Intn(5000))
+		if i == 3 {
+			// sampled by its hash, so changes in the middle are not noticed
+			data = make([]byte, 300000)
+		} else if i == 10 {
+			// sent on its own
+			data = make([]byte, 2*bundleFileSize)
+		}
+		rnd.Read(data)
+		source[name] = &fstest.MapFile{Data: data, Mode: 0644}
+		paths = append(paths, name)
+	}
+	defer os.RemoveAll("bdir")
+
+	var totalSize int64
+	for _, f := range source {
+		totalSize += int64(len(f.Data))
+	}
+	transfer := func(secret string) (receiver *Client, received int64) {
+		sender, err := New(Options{
+			IsSender:      true,
+			SharedSecret:  secret,
+			Debug:         true,
+			RelayAddress:  "localhost:8081",
+			RelayPorts:    []string{"8081"},
+			RelayPassword: "pass123",
+			NoPrompt:      true,
+			DisableLocal:  true,
+		})
+		if err != nil {
+			panic(err)
+		}
+		receiver, err = New(Options{
+			IsSender:      false,
+			SharedSecret:  secret,
+			Debug:         true,
+			RelayAddress:  "localhost:8081",
+			RelayPassword: "pass123",
+			NoPrompt:      true,
+			DisableLocal:  true,
+			Observer: ObserverFunc(func(e Event) {
+				if e.Type == EventFileProgress {
+					atomic.AddInt64(&received, e.Bytes)
+				}
+			}),
+		})
+		if err != nil {
+			panic(err)
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			err := sender.Send(TransferOptions{
+				Source:           source,
+				PathToFiles:      paths,
+				KeepPathInRemote: true,
+			})
+			if err != nil {
+				t.Errorf("send failed: %v", err)
+			}
+			wg.Done()
+		}()
+		time.Sleep(100 * time.Millisecond)
+		go func() {
+			err := receiver.Receive()
+			if err != nil {
+				t.Errorf("receive failed: %v", err)
+			}
+			wg.Done()
+		}()
+		wg.Wait()
+		for name, f := range source {
+			if f.Mode.IsDir() {
+				assert.DirExists(t, name)
+				continue
+			}
+			b, err := ioutil.ReadFile(name)
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(f.Data, b), name)
+		}
+		return
+	}
+
+	receiver, received := transfer("bundle-test")
+	assert.True(t, receiver.bundling)
+	assert.Equal(t, totalSize, received)
+
+	// files that are received again are only verified, apart from the
+	// file that was changed, which is repaired on its own
+	b, err := ioutil.ReadFile("bdir/f03.txt")
+	assert.Nil(t, err)
+	b[100000]++
+	assert.Nil(t, ioutil.WriteFile("bdir/f03.txt", b, 0644))
+	receiver, received = transfer("rebundle-test")
+	assert.Contains(t, receiver.receiveAlone, 5)
+	assert.True(t, received < int64(len(b)))
+}
+
+func TestCrocPipeline(t *testing.T) {
+	rnd := rand.New(rand.NewSource(7))
+	source := fstest.MapFS{}
+	var paths []string
+	var totalSize int64
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("pdir/p%d.bin", i)
+		data := make([]byte, bundleFileSize+rnd.Intn(3*bundleFileSize))
+		rnd.Read(data)
+		source[name] = &fstest.MapFile{Data: data, Mode: 0644}
+		paths = append(paths, name)
+		totalSize += int64(len(data))
+	}
+	defer os.RemoveAll("pdir")
+
+	sender, err := New(Options{
+		IsSender:      true,
+		SharedSecret:  "pipeline-test",
+		Debug:         true,
+		RelayAddress:  "localhost:8081",
+		RelayPorts:    []string{"8081"},
+		RelayPassword: "pass123",
+		NoPrompt:      true,
+		DisableLocal:  true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	var received int64
+	var finished []int
+	var mutex sync.Mutex
+	receiver, err := New(Options{
+		IsSender:      false,
+		SharedSecret:  "pipeline-test",
+		Debug:         true,
+		RelayAddress:  "localhost:8081",
+		RelayPassword: "pass123",
+		NoPrompt:      true,
+		DisableLocal:  true,
+		Observer: ObserverFunc(func(e Event) {
+			switch e.Type {
+			case EventFileProgress:
+				atomic.AddInt64(&received, e.Bytes)
+			case EventFileFinished:
+				mutex.Lock()
+				finished = append(finished, e.FileIndex)
+				mutex.Unlock()
+			}
+		}),
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		err := sender.Send(TransferOptions{
+			Source:           source,
+			PathToFiles:      paths,
+			KeepPathInRemote: true,
+		})
+		if err != nil {
+			t.Errorf("send failed: %v", err)
+		}
+		wg.Done()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	go func() {
+		err := receiver.Receive()
+		if err != nil {
+			t.Errorf("receive failed: %v", err)
+		}
+		wg.Done()
+	}()
+	wg.Wait()
+
+	assert.True(t, receiver.pipelining)
+	assert.Equal(t, totalSize, atomic.LoadInt64(&received))
+	assert.ElementsMatch(t, []int{0, 1, 2, 3, 4}, finished)
+	for name, f := range source {
+		b, err := ioutil.ReadFile(name)
+		assert.Nil(t, err)
+		assert.True(t, bytes.Equal(f.Data, b), name)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	c, err := New(Options{SharedSecret: "throttle-test", Throttle: "1M"})
+	assert.Nil(t, err)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			assert.Nil(t, c.throttle.wait(c.ctx, 250000))
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	assert.True(t, time.Since(start) >= 700*time.Millisecond)
+
+	// the limit can be lifted while data is sent
+	assert.Nil(t, c.SetThrottle(""))
+	start = time.Now()
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, c.throttle.wait(c.ctx, 250000))
+	}
+	assert.True(t, time.Since(start) < 100*time.Millisecond)
+
+	assert.NotNil(t, c.SetThrottle("fast"))
+	_, err = New(Options{SharedSecret: "throttle-test", Throttle: "5X"})
+	assert.NotNil(t, err)
+}
+
+func TestTuner(t *testing.T) {
+	measure := func(tu *tuner, bytes int64) {
+		tu.start()
+		tu.add(0)
+		tu.first = time.Now().Add(-time.Second)
+		tu.bytes = bytes
+		tu.finish()
+	}
+	tu := newTuner(4)
+	measure(tu, 40000000)
+	chunkSize, streams := tu.request()
+	assert.Equal(t, 3, streams)
+	assert.Equal(t, 128<<10, chunkSize)
+
+	// fewer streams that are slower are turned back
+	measure(tu, 20000000)
+	chunkSize, streams = tu.request()
+	assert.Equal(t, 4, streams)
+	assert.Equal(t, 32<<10, chunkSize)
+
+	// about the same throughput keeps the streams
+	measure(tu, 21000000)
+	_, streams = tu.request()
+	assert.Equal(t, 4, streams)
+
+	// small requests are not measured
+	measure(tu, 1000)
+	_, streams = tu.request()
+	assert.Equal(t, 4, streams)
+
+	c := &Client{Options: Options{RelayPorts: []string{"1", "2"}}}
+	assert.Nil(t, c.senderTune(RemoteFileRequest{ChunkSize: 1 << 20, Streams: 4}))
+	assert.Equal(t, 1<<20, c.chunkSize)
+	assert.Equal(t, 2, c.streams)
+	assert.Nil(t, c.senderTune(RemoteFileRequest{Streams: 1}))
+	assert.Equal(t, defaultChunkSize, c.chunkSize)
+	assert.Equal(t, 1, c.streams)
+	assert.NotNil(t, c.senderTune(RemoteFileRequest{ChunkSize: 10}))
+	assert.NotNil(t, c.senderTune(RemoteFileRequest{CurrentFileChunkRanges: []int64{0, 0, 1}}))
+}
+
+func TestMessageLimit(t *testing.T) {
+	large, err := message.Encode(nil, message.Message{Type: "error", Bytes: make([]byte, 1<<20)})
+	assert.Nil(t, err)
+	c := &Client{}
+	_, err = c.processMessage(large)
+	assert.True(t, errors.Is(err, compress.ErrTooLarge))
+
+	// the list of files can be large
+	c.Step1ChannelSecured = true
+	assert.Equal(t, maxMessageLimit, c.messageLimit())
+	c.Step2FileInfoTransfered = true
+	assert.Equal(t, controlMessageLimit, c.messageLimit())
+
+	// the digests are sized from the files requested
+	c.Step3RecipientRequestFile = true
+	c.pipeline = make([]PipelineFile, 2)
+	assert.Equal(t, controlMessageLimit+2*fileMessageLimit, c.messageLimit())
+	c.bundle = make([]BundleFile, bundleMaxFiles)
+	assert.Equal(t, maxMessageLimit, c.messageLimit())
+	digest := FileDigest{Hash: make([]byte, 32), BlockSize: 1, Blocks: make([][]byte, maxDigestBlocks)}
+	for i := range digest.Blocks {
+		digest.Blocks[i] = make([]byte, 32)
+	}
+	b, err := json.Marshal(digest)
+	assert.Nil(t, err)
+	b, err = json.Marshal(message.Message{Type: "close-recipient", Bytes: b})
+	assert.Nil(t, err)
+	assert.Less(t, len(b), fileMessageLimit)
+
+	// and the chunk ranges of the files that the sender is requested
+	sender := &Client{Options: Options{IsSender: true}, FilesToTransfer: make([]FileInfo, 100)}
+	assert.Equal(t, controlMessageLimit, sender.messageLimit())
+	sender.Step2FileInfoTransfered = true
+	assert.Equal(t, controlMessageLimit+pipelineMaxFiles*fileMessageLimit, sender.messageLimit())
+	sender.Step3RecipientRequestFile = true
+	assert.Equal(t, controlMessageLimit, sender.messageLimit())
+}
+
+func TestCrocTuned(t *testing.T) {
+	data := make([]byte, 3<<20)
+	rand.New(rand.NewSource(8)).Read(data)
+	source := fstest.MapFS{"tuned.bin": &fstest.MapFile{Data: data, Mode: 0644}}
+	defer os.Remove("tuned.bin")
+
+	sender, err := New(Options{
+		IsSender:      true,
+		SharedSecret:  "tuned-test",
+		Debug:         true,
+		RelayAddress:  "localhost:8081",
+		RelayPorts:    []string{"8081"},
+		RelayPassword: "pass123",
+		NoPrompt:      true,
+		DisableLocal:  true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	receiver, err := New(Options{
+		IsSender:      false,
+		SharedSecret:  "tuned-test",
+		Debug:         true,
+		RelayAddress:  "localhost:8081",
+		RelayPassword: "pass123",
+		NoPrompt:      true,
+		DisableLocal:  true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	receiver.tuner = &tuner{chunkSize: 256 << 10, streams: 2, maxStreams: 4, step: -1}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		err := sender.Send(TransferOptions{
+			Source:      source,
+			PathToFiles: []string{"tuned.bin"},
+		})
+		if err != nil {
+			t.Errorf("send failed: %v", err)
+		}
+		wg.Done()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	go func() {
+		err := receiver.Receive()
+		if err != nil {
+			t.Errorf("receive failed: %v", err)
+		}
+		wg.Done()
+	}()
+	wg.Wait()
+
+	assert.Equal(t, 256<<10, sender.chunkSize)
+	assert.Equal(t, 2, sender.streams)
+	assert.Equal(t, compress.Zstd, sender.compression)
+	b, err := ioutil.ReadFile("tuned.bin")
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(data, b))
+}
+
+func TestCrocVerify(t *testing.T) {
+	source := fstest.MapFS{"verify.txt": &fstest.MapFile{Data: []byte("verified"), Mode: 0644}}
+	defer os.Remove("verify.txt")
+
+	transfer := func(secret string, senderVerify, receiverVerify, confirm bool, delay time.Duration) (codes [2]string, confirmed [2]int32, errs [2]error) {
+		newClient := func(k int, isSender, verify bool) *Client {
+			c, err := New(Options{
+				IsSender:      isSender,
+				SharedSecret:  secret,
+				Debug:         true,
+				RelayAddress:  "localhost:8081",
+				RelayPorts:    []string{"8081"},
+				RelayPassword: "pass123",
+				NoPrompt:      true,
+				DisableLocal:  true,
+				Verify:        verify,
+				ConfirmVerification: func(code string) bool {
+					atomic.AddInt32(&confirmed[k], 1)
+					if !isSender {
+						time.Sleep(delay)
+					}
+					return confirm || isSender
+				},
+				Observer: ObserverFunc(func(e Event) {
+					if e.Type == EventVerification {
+						codes[k] = e.Code
+					}
+				}),
+			})
+			if err != nil {
+				panic(err)
+			}
+			return c
+		}
+		sender := newClient(0, true, senderVerify)
+		receiver := newClient(1, false, receiverVerify)
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			errs[0] = sender.Send(TransferOptions{Source: source, PathToFiles: []string{"verify.txt"}})
+			wg.Done()
+		}()
+		time.Sleep(100 * time.Millisecond)
+		go func() {
+			errs[1] = receiver.Receive()
+			wg.Done()
+		}()
+		wg.Wait()
+		return
+	}
+
+	// either side makes both users confirm the same code
+	codes, confirmed, errs := transfer("verify-test", false, true, true, 0)
+	assert.Nil(t, errs[0])
+	assert.Nil(t, errs[1])
+	assert.Len(t, strings.Split(codes[0], "-"), 3)
+	assert.Equal(t, codes[0], codes[1])
+	assert.Equal(t, [2]int32{1, 1}, confirmed)
+	b, err := ioutil.ReadFile("verify.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, "verified", string(b))
+	os.Remove("verify.txt")
+
+	// and no files are sent if a user does not confirm it
+	codes, confirmed, errs = transfer("refuse-test", true, false, false, 0)
+	assert.NotNil(t, errs[0])
+	assert.NotNil(t, errs[1])
+	assert.NotEqual(t, "", codes[1])
+	assert.Equal(t, int32(1), confirmed[1])
+	_, err = os.Stat("verify.txt")
+	assert.True(t, os.IsNotExist(err))
+
+	// or in time
+	defer func(timeout time.Duration) { verificationTimeout = timeout }(verificationTimeout)
+	verificationTimeout = 200 * time.Millisecond
+	_, _, errs = transfer("timeout-test", true, false, true, time.Second)
+	assert.NotNil(t, errs[0])
+	assert.Contains(t, errs[0].Error(), "did not confirm")
+	assert.NotNil(t, errs[1])
+	_, err = os.Stat("verify.txt")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestVerificationCode(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.New(rand.NewSource(25)).Read(sessionKey)
+	transcript := handshakeTranscript([]byte("salt"), handshakeVersion, "aes-gcm,chacha20-poly1305", "aes-gcm")
+	code, err := verificationCode(sessionKey, transcript)
+	assert.Nil(t, err)
+	assert.Len(t, strings.Split(code, "-"), 3)
+	same, err := verificationCode(sessionKey, transcript)
+	assert.Nil(t, err)
+	assert.Equal(t, code, same)
+
+	// a relay that changed the handshake or the key changes the code
+	other, err := verificationCode(sessionKey, handshakeTranscript([]byte("salt"), handshakeVersion, "aes-gcm", "aes-gcm"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, code, other)
+	sessionKey[0]++
+	other, err = verificationCode(sessionKey, transcript)
+	assert.Nil(t, err)
+	assert.NotEqual(t, code, other)
+
+	c := &Client{}
+	assert.Nil(t, c.checkVerification(handshakeCounters))
+	c.Options.Verify = true
+	assert.NotNil(t, c.checkVerification(handshakeCounters))
+	assert.Nil(t, c.checkVerification(handshakeVerification))
+	c.Options.Verify = false
+	assert.True(t, c.verificationDone())
+	c.peerVerify = true
+	assert.False(t, c.verificationDone())
+	c.verified, c.peerVerified = true, true
+	assert.True(t, c.verificationDone())
+}
+
+func TestChunkCompression(t *testing.T) {
+	text := bytes.Repeat([]byte("the frog and the crocodile "), 1000)
+	random := make([]byte, len(text))
+	rand.New(rand.NewSource(9)).Read(random)
+	header := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	for _, algorithm := range []compress.Algorithm{compress.Zstd, compress.Flate} {
+		sender := &Client{
+			Options:         Options{RelayPorts: []string{"1"}},
+			FilesToTransfer: []FileInfo{{Name: "a.txt"}, {Name: "b.bin"}, {Name: "c.zip", IsCompressed: true}},
+		}
+		assert.Nil(t, sender.senderInitializeCompression(algorithm))
+		receiver := &Client{compression: chooseCompression([]compress.Algorithm{"lzma", algorithm})}
+		assert.Equal(t, algorithm, receiver.compression)
+
+		// compressible data is compressed, and the rest is not
+		chunk := sender.encodeChunk(0, 0, header, text)
+		assert.Equal(t, chunkMethod(algorithm), chunk[0])
+		assert.True(t, len(chunk) < len(text)/2)
+		decoded, err := receiver.decodeChunk(chunk, len(header))
+		assert.Nil(t, err)
+		assert.Equal(t, append(append([]byte{}, header...), text...), decoded)
+
+		chunk = sender.encodeChunk(0, 1, header, random)
+		assert.Equal(t, chunkRaw, chunk[0])
+		// after a trial that did not save enough, even
+		// compressible data of the file is not compressed
+		chunk = sender.encodeChunk(0, 1, header, text)
+		assert.Equal(t, chunkRaw, chunk[0])
+		decoded, err = receiver.decodeChunk(chunk, len(header))
+		assert.Nil(t, err)
+		assert.Equal(t, append(append([]byte{}, header...), text...), decoded)
+
+		chunk = sender.encodeChunk(0, 2, header, text)
+		assert.Equal(t, chunkRaw, chunk[0])
+	}
+
+	receiver := &Client{compression: compress.Zstd}
+	_, err := receiver.decodeChunk([]byte{chunkZstd, 1, 2}, 8)
+	assert.NotNil(t, err)
+	// chunks that decompress to more than the chunk size are refused
+	bomb, err := compress.CompressWith(make([]byte, 64<<20), compress.Zstd)
+	assert.Nil(t, err)
+	_, err = receiver.decodeChunk(append(append([]byte{chunkZstd}, header...), bomb...), 8)
+	assert.Equal(t, compress.ErrTooLarge, err)
+	receiver = &Client{}
+	_, err = receiver.decodeChunk(compress.CompressWithOption(make([]byte, 64<<20), 9), 8)
+	assert.Equal(t, compress.ErrTooLarge, err)
+	_, err = receiver.decodeChunk(append([]byte{9}, header...), 8)
+	assert.NotNil(t, err)
+	assert.NotNil(t, (&Client{}).senderInitializeCompression("lzma"))
+}
+
+func TestChunkContext(t *testing.T) {
+	key := make([]byte, 32)
+	rand.New(rand.NewSource(21)).Read(key)
+	aead, err := crypt.NewAEAD(crypt.AESGCM, key)
+	assert.Nil(t, err)
+	sender := &Client{
+		sendAEAD:        aead,
+		Options:         Options{RelayPorts: []string{"1"}},
+		FilesToTransfer: []FileInfo{{Name: "a.txt"}, {Name: "b.txt"}},
+		chunkContext:    true,
+	}
+	assert.Nil(t, sender.senderInitializeCompression(compress.Zstd))
+	receiver := &Client{receiveAEAD: aead, FilesToTransfer: sender.FilesToTransfer, compression: compress.Zstd, chunkContext: true}
+	data := bytes.Repeat([]byte("the frog and the crocodile "), 100)
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint64(header, 1024)
+
+	chunk, err := sender.sealChunk(0, 1, header, data)
+	assert.Nil(t, err)
+	index, decoded, err := receiver.openChunk(0, chunk, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, index)
+	assert.Equal(t, append(append([]byte{}, header...), data...), decoded)
+	// chunks of a pipeline keep the index in their header
+	_, decoded, err = receiver.openChunk(0, chunk, 12)
+	assert.Nil(t, err)
+	assert.Equal(t, chunk[:12], decoded[:12])
+	assert.Nil(t, checkChunkIndex(index, 1))
+	assert.NotNil(t, checkChunkIndex(index, 0))
+
+	// a chunk replayed as that of another file or position is refused
+	replayed := append([]byte{}, chunk...)
+	binary.LittleEndian.PutUint32(replayed[8:], 0)
+	_, _, err = receiver.openChunk(0, replayed, 8)
+	assert.NotNil(t, err)
+	replayed = append([]byte{}, chunk...)
+	binary.LittleEndian.PutUint64(replayed, 0)
+	_, _, err = receiver.openChunk(0, replayed, 8)
+	assert.NotNil(t, err)
+	// as is one sent in the other direction
+	sealed, err := crypt.EncryptWith(data, key, chunkAssociatedData('r', chunk[:12]))
+	assert.Nil(t, err)
+	_, _, err = receiver.openChunk(0, append(append([]byte{}, chunk[:12]...), sealed...), 8)
+	assert.NotNil(t, err)
+	_, _, err = receiver.openChunk(0, chunk[:4], 8)
+	assert.NotNil(t, err)
+
+	// chunks without context are not refused for their index
+	sender.chunkContext, receiver.chunkContext = false, false
+	chunk, err = sender.sealChunk(0, 1, header, data)
+	assert.Nil(t, err)
+	index, decoded, err = receiver.openChunk(0, chunk, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, -1, index)
+	assert.Equal(t, append(append([]byte{}, header...), data...), decoded)
+	assert.Nil(t, checkChunkIndex(index, 0))
+}
+
+func TestHandshake(t *testing.T) {
+	assert.Equal(t, handshakeLegacy, chooseHandshake(0))
+	assert.Equal(t, handshakeHKDF, chooseHandshake(handshakeHKDF))
+	assert.Equal(t, handshakeVersion, chooseHandshake(handshakeVersion+1))
+
+	sessionKey := make([]byte, 32)
+	rand.New(rand.NewSource(22)).Read(sessionKey)
+	salt := []byte("0123456789abcdef")
+	sender := &Client{Options: Options{IsSender: true}, mutex: &sync.Mutex{}}
+	receiver := &Client{mutex: &sync.Mutex{}}
+	offered := sender.offeredCiphers()
+	for _, version := range []int{handshakeLegacy, handshakeHKDF, handshakeCounters, handshakeDirectories, handshakeVerification} {
+		for _, cipher := range crypt.Ciphers {
+			assert.Nil(t, sender.deriveKeys(sessionKey, salt, version, offered, cipher))
+			assert.Nil(t, receiver.deriveKeys(sessionKey, salt, version, offered, cipher))
+			assert.Equal(t, sender.Key, receiver.Key)
+			assert.Equal(t, sender.dataCipher, receiver.dataCipher)
+			assert.Nil(t, receiver.checkHandshake(version))
+
+			// the data of each peer is decrypted by the other only
+			sealed, err := sender.sealData(1, []byte("data"), nil)
+			assert.Nil(t, err)
+			opened, err := receiver.openData(1, sealed, nil)
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("data"), opened)
+			_, err = sender.openData(1, sealed, nil)
+			assert.Equal(t, version == handshakeLegacy, err == nil)
+			// and from version 2 only once and over its own connection
+			_, err = receiver.openData(1, sealed, nil)
+			assert.Equal(t, version < handshakeCounters, err == nil)
+			_, err = receiver.openData(2, sealed, nil)
+			assert.Equal(t, version < handshakeCounters, err == nil)
+		}
+	}
+	// the messages have their own key from version 1
+	legacyKey, _, err := crypt.New(sessionKey, salt)
+	assert.Nil(t, err)
+	assert.NotEqual(t, legacyKey, sender.Key)
+	// and a relay that changes the ciphers changes the keys
+	key := sender.Key
+	assert.Nil(t, receiver.deriveKeys(sessionKey, salt, handshakeHKDF, string(crypt.AESGCM), crypt.XChaCha20Poly1305))
+	assert.NotEqual(t, key, receiver.Key)
+
+	// a relay that makes the sender offer less is found out
+	assert.Nil(t, receiver.deriveKeys(sessionKey, salt, handshakeLegacy, "", ""))
+	assert.Equal(t, crypt.AESGCM, receiver.dataCipher)
+	assert.NotNil(t, receiver.checkHandshake(handshakeVersion))
+	assert.NotNil(t, receiver.deriveKeys(sessionKey, salt, handshakeVersion+1, offered, crypt.AESGCM))
+}
+
+func TestRekey(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	rand.New(rand.NewSource(24)).Read(sessionKey)
+	salt := []byte("0123456789abcdef")
+	sender := &Client{Options: Options{IsSender: true, RekeyChunks: 4, RekeyBytes: 3 * 100}, mutex: &sync.Mutex{}}
+	receiver := &Client{mutex: &sync.Mutex{}}
+	offered := sender.offeredCiphers()
+	assert.Nil(t, sender.deriveKeys(sessionKey, salt, handshakeCounters, offered, crypt.ChaCha20Poly1305))
+	assert.Nil(t, receiver.deriveKeys(sessionKey, salt, handshakeCounters, offered, crypt.ChaCha20Poly1305))
+
+	// each data connection counts its nonces on its own, and its
+	// key is replaced after 4 chunks or 300 bytes
+	nonces := make(map[string]struct{})
+	for k := 0; k < 20; k++ {
+		for i := 0; i < 2; i++ {
+			size := 10
+			if i == 1 {
+				size = 100
+			}
+			sealed, err := sender.sealData(i, make([]byte, size), nil)
+			assert.Nil(t, err)
+			nonce := string(sealed[:12])
+			if i == 0 {
+				_, repeated := nonces[nonce]
+				assert.False(t, repeated)
+				nonces[nonce] = struct{}{}
+			}
+			_, err = receiver.openData(i, sealed, nil)
+			assert.Nil(t, err)
+		}
+	}
+	assert.Equal(t, uint32(4), sender.sendStreams[0].Generation())
+	assert.Equal(t, uint32(6), sender.sendStreams[1].Generation())
+	assert.Equal(t, uint32(4), receiver.receiveStreams[0].Generation())
+	assert.Equal(t, uint32(6), receiver.receiveStreams[1].Generation())
+
+	_, err := New(Options{RekeyChunks: -1})
+	assert.NotNil(t, err)
+}
+
+func TestChooseCipher(t *testing.T) {
+	sender := &Client{Options: Options{IsSender: true}}
+	receiver := &Client{}
+	offered := sender.offeredCiphers()
+	assert.True(t, strings.HasPrefix(offered, string(crypt.Preferred())))
+	cipher, err := receiver.chooseCipher(offered)
+	assert.Nil(t, err)
+	assert.Equal(t, crypt.Preferred(), cipher)
+
+	// without AES instructions on either side it is ChaCha20-Poly1305
+	cipher, err = receiver.chooseCipher("chacha20-poly1305,aes-gcm,xchacha20-poly1305")
+	assert.Nil(t, err)
+	assert.Equal(t, crypt.ChaCha20Poly1305, cipher)
+	cipher, err = receiver.chooseCipher("rot13,xchacha20-poly1305")
+	assert.Nil(t, err)
+	assert.Equal(t, crypt.XChaCha20Poly1305, cipher)
+	_, err = receiver.chooseCipher("rot13")
+	assert.NotNil(t, err)
+
+	// unless it is set by either of them
+	sender.Options.Cipher = crypt.XChaCha20Poly1305
+	assert.Equal(t, "xchacha20-poly1305", sender.offeredCiphers())
+	receiver.Options.Cipher = crypt.AESGCM
+	cipher, err = receiver.chooseCipher(offered)
+	assert.Nil(t, err)
+	assert.Equal(t, crypt.AESGCM, cipher)
+	_, err = receiver.chooseCipher(sender.offeredCiphers())
+	assert.NotNil(t, err)
+
+	_, err = New(Options{Cipher: "rot13"})
+	assert.NotNil(t, err)
+}
+
+func TestCrocMetadata(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "metadata")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	if _, err = tmpfile.WriteString("#!/bin/sh\necho hello\n"); err != nil {
+		panic(err)
+	}
+	tmpfile.Close()
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.Nil(t, os.Chmod(tmpfile.Name(), 0750))
+	assert.Nil(t, os.Chtimes(tmpfile.Name(), modTime, modTime))
+	_, fname := filepath.Split(tmpfile.Name())
+	defer os.Remove(fname)
+
+	sender, err := New(Options{
+		IsSender:      true,
+		SharedSecret:  "metadata-test",
+		Debug:         true,
+		RelayAddress:  "localhost:8081",
+		RelayPorts:    []string{"8081"},
+		RelayPassword: "pass123",
+		NoPrompt:      true,
+		DisableLocal:  true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	receiver, err := New(Options{
+		IsSender:      false,
+		SharedSecret:  "metadata-test",
+		Debug:         true,
+		RelayAddress:  "localhost:8081",
+		RelayPassword: "pass123",
+		NoPrompt:      true,
+		DisableLocal:  true,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		err := sender.Send(TransferOptions{
+			PathToFiles: []string{tmpfile.Name()},
+		})
+		if err != nil {
+			t.Errorf("send failed: %v", err)
+		}
+		wg.Done()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	go func() {
+		err := receiver.Receive()
+		if err != nil {
+			t.Errorf("receive failed: %v", err)
+		}
+		wg.Done()
+	}()
+	wg.Wait()
+
+	stat, err := os.Stat(fname)
+	assert.Nil(t, err)
+	if err == nil {
+		assert.True(t, stat.ModTime().Equal(modTime), "got %s", stat.ModTime())
+		if runtime.GOOS != "windows" {
+			assert.Equal(t, os.FileMode(0750), stat.Mode().Perm())
+		}
+	}
+}
+
+func TestCrocEmptyDirectory(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "tree")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	emptyDir := filepath.Join(tmpdir, "emptydir-test")
+	assert.Nil(t, os.Mkdir(emptyDir, 0750))
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.Nil(t, os.Chtimes(emptyDir, modTime, modTime))
+	fileInTree := filepath.Join(tmpdir, "emptydir-test.txt")
+	assert.Nil(t, ioutil.WriteFile(fileInTree, []byte("hello"), 0644))
+	defer os.RemoveAll("emptydir-test")
+	defer os.Remove("emptydir-test.txt")
+
+	sender, err := New(Options{
+		IsSender:      true,
+		SharedSecret:  "emptydir-test",
+		Debug:         true,
+		RelayAddress:  "localhost:8081",
+		RelayPorts:    []string{"8081"},
+		RelayPassword: "pass123",
+		NoPrompt:      true,
+		DisableLocal:  true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	receiver, err := New(Options{
+		IsSender:      false,
+		SharedSecret:  "emptydir-test",
+		Debug:         true,
+		RelayAddress:  "localhost:8081",
+		RelayPassword: "pass123",
+		NoPrompt:      true,
+		DisableLocal:  true,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		err := sender.Send(TransferOptions{
+			PathToFiles: []string{emptyDir, fileInTree},
+		})
+		if err != nil {
+			t.Errorf("send failed: %v", err)
+		}
+		wg.Done()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	go func() {
+		err := receiver.Receive()
+		if err != nil {
+			t.Errorf("receive failed: %v", err)
+		}
+		wg.Done()
+	}()
+	wg.Wait()
+
+	assert.True(t, receiver.FilesToTransfer[0].IsDir)
+	stat, err := os.Stat("emptydir-test")
+	assert.Nil(t, err)
+	if err == nil {
+		assert.True(t, stat.IsDir())
+		assert.True(t, stat.ModTime().Equal(modTime), "got %s", stat.ModTime())
+	}
+	b, err := ioutil.ReadFile("emptydir-test.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(b))
+}
+
+func TestWithoutDirectories(t *testing.T) {
+	files := []FileInfo{
+		{Name: "root", FolderRemote: ".", IsDir: true},
+		{Name: "full", FolderRemote: "root", IsDir: true},
+		{Name: "nested", FolderRemote: "root/full", IsDir: true},
+		{Name: "empty", FolderRemote: "root", IsDir: true},
+		{Name: "file", FolderRemote: "root/full/nested"},
+	}
+	kept := withoutDirectories(files)
+	assert.Equal(t, []FileInfo{files[3], files[4]}, kept)
+	assert.Equal(t, []FileInfo{{Name: "empty", FolderRemote: ".", IsDir: true}},
+		withoutDirectories([]FileInfo{{Name: "empty", FolderRemote: ".", IsDir: true}}))
+}
+
+func TestCrocRefuseSymlink(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "symlink")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	link := filepath.Join(tmpdir, "symlink-test")
+	assert.Nil(t, os.Symlink("/etc/passwd", link))
+	defer os.Remove("symlink-test")
+
+	sender, err := New(Options{
+		IsSender:      true,
+		SharedSecret:  "symlink-test",
+		Debug:         true,
+		RelayAddress:  "localhost:8081",
+		RelayPorts:    []string{"8081"},
+		RelayPassword: "pass123",
+		NoPrompt:      true,
+		DisableLocal:  true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	receiver, err := New(Options{
+		IsSender:      false,
+		SharedSecret:  "symlink-test",
+		Debug:         true,
+		RelayAddress:  "localhost:8081",
+		RelayPassword: "pass123",
+		NoPrompt:      true,
+		DisableLocal:  true,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	var wg sync.WaitGroup
+	var sendErr, receiveErr error
+	wg.Add(2)
+	go func() {
+		sendErr = sender.Send(TransferOptions{
+			PathToFiles: []string{link},
+		})
+		wg.Done()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	go func() {
+		receiveErr = receiver.Receive()
+		wg.Done()
+	}()
+	wg.Wait()
+
+	assert.True(t, errors.Is(receiveErr, ErrUnsafePath), "got %v", receiveErr)
+	if assert.NotNil(t, sendErr) {
+		assert.Contains(t, sendErr.Error(), "refusing files")
+	}
+	_, err = os.Lstat("symlink-test")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCrocConflict(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "conflict")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	if _, err = tmpfile.WriteString("new content"); err != nil {
+		panic(err)
+	}
+	tmpfile.Close()
+	_, fname := filepath.Split(tmpfile.Name())
+	renamed := fname + "-1"
+	defer os.Remove(fname)
+	defer os.Remove(renamed)
+
+	for _, tc := range []struct {
+		policy   ConflictPolicy
+		existing string
+		renamed  string
+		event    EventType
+	}{
+		{ConflictSkip, "old content", "", EventFileSkipped},
+		{ConflictRename, "old content", "new content", EventFileRenamed},
+		{ConflictOverwrite, "new content", "", EventFileStarted},
+	} {
+		os.Remove(renamed)
+		assert.Nil(t, ioutil.WriteFile(fname, []byte("old content"), 0644))
+		secret := string(tc.policy) + "-test"
+		sender, err := New(Options{
+			IsSender:      true,
+			SharedSecret:  secret,
+			Debug:         true,
+			RelayAddress:  "localhost:8081",
+			RelayPorts:    []string{"8081"},
+			RelayPassword: "pass123",
+			NoPrompt:      true,
+			DisableLocal:  true,
+		})
+		if err != nil {
+			panic(err)
+		}
+		var events []EventType
+		var eventsMutex sync.Mutex
+		receiver, err := New(Options{
+			IsSender:       false,
+			SharedSecret:   secret,
+			Debug:          true,
+			RelayAddress:   "localhost:8081",
+			RelayPassword:  "pass123",
+			NoPrompt:       true,
+			DisableLocal:   true,
+			ConflictPolicy: tc.policy,
+			Observer: ObserverFunc(func(e Event) {
+				eventsMutex.Lock()
+				events = append(events, e.Type)
+				eventsMutex.Unlock()
+			}),
+		})
+		if err != nil {
+			panic(err)
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			err := sender.Send(TransferOptions{
+				PathToFiles: []string{tmpfile.Name()},
+			})
+			if err != nil {
+				t.Errorf("send failed: %v", err)
+			}
+			wg.Done()
+		}()
+		time.Sleep(100 * time.Millisecond)
+		go func() {
+			err := receiver.Receive()
+			if err != nil {
+				t.Errorf("receive failed: %v", err)
+			}
+			wg.Done()
+		}()
+		wg.Wait()
+
+		assert.Contains(t, events, tc.event, "%s", tc.policy)
+		b, _ := ioutil.ReadFile(fname)
+		assert.Equal(t, tc.existing, string(b), "%s", tc.policy)
+		b, _ = ioutil.ReadFile(renamed)
+		assert.Equal(t, tc.renamed, string(b), "%s", tc.policy)
+	}
+}
+
+func TestCrocConflictSampled(t *testing.T) {
+	// the files differ where the hash does not sample them
+	content := make([]byte, 200000)
+	existing := make([]byte, len(content))
+	existing[40000] = 1
+	tmpfile, err := ioutil.TempFile("", "conflict")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	if _, err = tmpfile.Write(content); err != nil {
+		panic(err)
+	}
+	tmpfile.Close()
+	_, fname := filepath.Split(tmpfile.Name())
+	renamed := fname + "-1"
+	defer os.Remove(fname)
+	defer os.Remove(renamed)
+
+	for _, tc := range []struct {
+		policy  ConflictPolicy
+		renamed []byte
+		event   EventType
+	}{
+		{ConflictSkip, nil, EventFileSkipped},
+		{ConflictRename, content, EventFileRenamed},
+	} {
+		os.Remove(renamed)
+		assert.Nil(t, ioutil.WriteFile(fname, existing, 0644))
+		h1, _ := utils.HashFile(tmpfile.Name())
+		h2, _ := utils.HashFile(fname)
+		assert.Equal(t, h1, h2)
+		secret := string(tc.policy) + "-sampled-test"
+		sender, err := New(Options{
+			IsSender:      true,
+			SharedSecret:  secret,
+			Debug:         true,
+			RelayAddress:  "localhost:8081",
+			RelayPorts:    []string{"8081"},
+			RelayPassword: "pass123",
+			NoPrompt:      true,
+			DisableLocal:  true,
+		})
+		if err != nil {
+			panic(err)
+		}
+		var events []EventType
+		var eventsMutex sync.Mutex
+		receiver, err := New(Options{
+			IsSender:       false,
+			SharedSecret:   secret,
+			Debug:          true,
+			RelayAddress:   "localhost:8081",
+			RelayPassword:  "pass123",
+			NoPrompt:       true,
+			DisableLocal:   true,
+			ConflictPolicy: tc.policy,
+			Observer: ObserverFunc(func(e Event) {
+				eventsMutex.Lock()
+				events = append(events, e.Type)
+				eventsMutex.Unlock()
+			}),
+		})
+		if err != nil {
+			panic(err)
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			err := sender.Send(TransferOptions{
+				PathToFiles: []string{tmpfile.Name()},
+			})
+			if err != nil {
+				t.Errorf("send failed: %v", err)
+			}
+			wg.Done()
+		}()
+		time.Sleep(100 * time.Millisecond)
+		go func() {
+			err := receiver.Receive()
+			if err != nil {
+				t.Errorf("receive failed: %v", err)
+			}
+			wg.Done()
+		}()
+		wg.Wait()
+
+		assert.Contains(t, events, tc.event, "%s", tc.policy)
+		assert.NotContains(t, events, EventFileExists, "%s", tc.policy)
+		b, _ := ioutil.ReadFile(fname)
+		assert.Equal(t, existing, b, "%s", tc.policy)
+		b, _ = ioutil.ReadFile(renamed)
+		assert.Equal(t, tc.renamed, b, "%s", tc.policy)
+	}
+}
+
+func TestConflictFreeName(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "names")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(tmpdir, "a-1.txt"), []byte{}, 0644))
+	c := &Client{}
+	assert.Equal(t, "a-2.txt", c.conflictFreeName(tmpdir, "a.txt"))
+	assert.Equal(t, "b-1", c.conflictFreeName(tmpdir, "b"))
+	assert.Equal(t, ".bashrc-1", c.conflictFreeName(tmpdir, ".bashrc"))
+
+	// names of files still to receive, or renamed to, are taken too
+	c.FilesToTransfer = []FileInfo{
+		{Name: "a-2.txt", FolderRemote: tmpdir},
+		{Name: "a-3.txt", FolderRemote: tmpdir},
+		{Name: "b-1", FolderRemote: "elsewhere"},
+	}
+	assert.Equal(t, "a-4.txt", c.conflictFreeName(tmpdir, "a.txt"))
+	assert.Equal(t, "b-1", c.conflictFreeName(tmpdir, "b"))
+}
+
+func TestValidateManifest(t *testing.T) {
+	for _, tc := range []struct {
+		fi     FileInfo
+		policy SymlinkPolicy
+		safe   bool
+	}{
+		{FileInfo{Name: "a", FolderRemote: "."}, SymlinkInside, true},
+		{FileInfo{Name: "a", FolderRemote: "b/./c/.."}, SymlinkInside, true},
+		{FileInfo{Name: "a"}, SymlinkInside, true},
+		{FileInfo{Name: "a", FolderRemote: "../b"}, SymlinkInside, false},
+		{FileInfo{Name: "a", FolderRemote: "b/../../c"}, SymlinkInside, false},
+		{FileInfo{Name: "a", FolderRemote: "/etc"}, SymlinkAllow, false},
+		{FileInfo{Name: "..", FolderRemote: "."}, SymlinkInside, false},
+		{FileInfo{Name: "a/b", FolderRemote: "."}, SymlinkInside, false},
+		{FileInfo{Name: "", FolderRemote: "."}, SymlinkInside, false},
+		{FileInfo{Name: "a", FolderRemote: "b", Symlink: "../c"}, SymlinkInside, true},
+		{FileInfo{Name: "a", FolderRemote: "b", Symlink: "../../c"}, SymlinkInside, false},
+		{FileInfo{Name: "a", FolderRemote: ".", Symlink: "/etc/passwd"}, SymlinkInside, false},
+		{FileInfo{Name: "a", FolderRemote: ".", Symlink: "/etc/passwd"}, SymlinkAllow, true},
+		{FileInfo{Name: "a", FolderRemote: ".", Symlink: "c"}, SymlinkRefuse, false},
+	} {
+		err := validateManifest([]FileInfo{tc.fi}, tc.policy)
+		assert.Equal(t, tc.safe, err == nil, "%+v %s: %v", tc.fi, tc.policy, err)
+	}
+
+	// nothing is received through a symlink of the same transfer
+	files := []FileInfo{
+		{Name: "a", FolderRemote: ".", Symlink: "/etc"},
+		{Name: "passwd", FolderRemote: "a"},
+	}
+	assert.True(t, errors.Is(validateManifest(files, SymlinkAllow), ErrUnsafePath))
+
+	// symlinks are followed through the other symlinks of the manifest
+	files = []FileInfo{
+		{Name: "y", FolderRemote: ".", Symlink: "."},
+		{Name: "x", FolderRemote: ".", Symlink: "y/../etc"},
+	}
+	assert.True(t, errors.Is(validateManifest(files, SymlinkInside), ErrUnsafePath))
+	files = []FileInfo{
+		{Name: "x", FolderRemote: ".", Symlink: "y/../etc"},
+		{Name: "y", FolderRemote: ".", Symlink: "."},
+	}
+	assert.True(t, errors.Is(validateManifest(files, SymlinkInside), ErrUnsafePath))
+	files = []FileInfo{
+		{Name: "y", FolderRemote: ".", Symlink: "y"},
+	}
+	assert.True(t, errors.Is(validateManifest(files, SymlinkInside), ErrUnsafePath))
+	files = []FileInfo{
+		{Name: "y", FolderRemote: "a", Symlink: "../b"},
+		{Name: "x", FolderRemote: ".", Symlink: "a/y/../c"},
+	}
+	assert.Nil(t, validateManifest(files, SymlinkInside))
+
+	// folders are normalized
+	files = []FileInfo{{Name: "a", FolderRemote: "b/./c/.."}}
+	assert.Nil(t, validateManifest(files, SymlinkInside))
+	assert.Equal(t, "b", files[0].FolderRemote)
+}
+
+func TestCheckInsideRoot(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "root")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	assert.Nil(t, os.Symlink(tmpdir, "insideroot-test"))
+	defer os.Remove("insideroot-test")
+
+	assert.Nil(t, checkInsideRoot("insideroot-test-missing/a/b"))
+	assert.True(t, errors.Is(checkInsideRoot("insideroot-test/a"), ErrUnsafePath))
+	assert.True(t, errors.Is(checkInsideRoot("insideroot-test"), ErrUnsafePath))
+}
+
+func TestMismatchedChunkRanges(t *testing.T) {
+	content := make([]byte, 200000)
+	d := newDigester(int64(len(content)))
+	d.Write(content)
+	remote := d.Sum()
+
+	content[100000] = 1
+	d = newDigester(int64(len(content)))
+	d.Write(content[:1000])
+	d.Write(content[1000:])
+	local := d.Sum()
+
+	assert.NotEqual(t, remote.Hash, local.Hash)
+	assert.Equal(t, []int64{32768, 98304, 1}, mismatchedChunkRanges(local, remote, int64(len(content))))
+	assert.Empty(t, mismatchedChunkRanges(remote, remote, int64(len(content))))
+}
+
+func TestVerifyLegacyFile(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "legacy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	go io.Copy(ioutil.Discard, peer)
+
+	pathToFile := filepath.Join(tmpdir, "file")
+	assert.Nil(t, ioutil.WriteFile(partialPath(pathToFile), []byte("corrupted"), 0644))
+	c := &Client{
+		conn:            []*comm.Comm{comm.New(conn)},
+		FilesToTransfer: []FileInfo{{Name: "file", FolderRemote: tmpdir, Hash: []byte("hash")}},
+	}
+	// a sender without digests has the file requested again until the limit
+	for i := 1; i < maxVerifyAttempts; i++ {
+		assert.Nil(t, c.recipientVerifyFile(nil))
+	}
+	err = c.recipientVerifyFile(nil)
+	var transferErr *TransferError
+	assert.True(t, errors.As(err, &transferErr))
+	assert.Equal(t, "verify", transferErr.Op)
+	assert.True(t, c.errorShared)
+	assert.False(t, utils.Exists(partialPath(pathToFile)))
+}
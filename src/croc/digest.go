@@ -0,0 +1,135 @@
+package croc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/schollz/croc/v8/src/models"
+)
+
+// maxDigestBlocks limits the number of block digests sent for a file
+const maxDigestBlocks = 4096
+
+// maxVerifyAttempts is the number of times a file is re-requested
+// before giving up on its integrity
+const maxVerifyAttempts = 3
+
+// FileDigest is the SHA-256 of the full content of a file along
+// with the digests of its blocks, which are used to find which
+// chunks need to be transferred again
+type FileDigest struct {
+	Hash      []byte   `json:"h"`
+	BlockSize int64    `json:"bs"`
+	Blocks    [][]byte `json:"b"`
+}
+
+// digester computes a FileDigest from the content written to it
+type digester struct {
+	full      hash.Hash
+	block     hash.Hash
+	blockSize int64
+	blockN    int64
+	blocks    [][]byte
+}
+
+// digestBlockSize returns the block size used for a file of the given
+// size, which is a multiple of the chunk size
+func digestBlockSize(size int64) int64 {
+	chunkSize := int64(models.TCP_BUFFER_SIZE / 2)
+	numChunks := (size + chunkSize - 1) / chunkSize
+	chunksPerBlock := (numChunks + maxDigestBlocks - 1) / maxDigestBlocks
+	if chunksPerBlock < 1 {
+		chunksPerBlock = 1
+	}
+	return chunksPerBlock * chunkSize
+}
+
+func newDigester(size int64) *digester {
+	return &digester{
+		full:      sha256.New(),
+		block:     sha256.New(),
+		blockSize: digestBlockSize(size),
+	}
+}
+
+func (d *digester) Write(p []byte) (n int, err error) {
+	d.full.Write(p)
+	for len(p) > 0 {
+		m := d.blockSize - d.blockN
+		if int64(len(p)) < m {
+			m = int64(len(p))
+		}
+		d.block.Write(p[:m])
+		d.blockN += m
+		n += int(m)
+		p = p[m:]
+		if d.blockN == d.blockSize {
+			d.endBlock()
+		}
+	}
+	return
+}
+
+func (d *digester) endBlock() {
+	d.blocks = append(d.blocks, d.block.Sum(nil))
+	d.block.Reset()
+	d.blockN = 0
+}
+
+// Sum returns the digest of everything written
+func (d *digester) Sum() FileDigest {
+	if d.blockN > 0 {
+		d.endBlock()
+	}
+	return FileDigest{
+		Hash:      d.full.Sum(nil),
+		BlockSize: d.blockSize,
+		Blocks:    d.blocks,
+	}
+}
+
+// digestFile computes the digest of a file on disk
+func digestFile(fname string, size int64) (digest FileDigest, err error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	return digestReader(f, size)
+}
+
+// digestReader computes the digest of the content read from r,
+// which is size bytes long
+func digestReader(r io.Reader, size int64) (digest FileDigest, err error) {
+	d := newDigester(size)
+	if _, err = io.Copy(d, r); err != nil {
+		return
+	}
+	digest = d.Sum()
+	return
+}
+
+// mismatchedChunkRanges returns the chunk ranges of the blocks
+// of local that differ from remote, in the format of
+// RemoteFileRequest.CurrentFileChunkRanges
+func mismatchedChunkRanges(local, remote FileDigest, size int64) (chunkRanges []int64) {
+	chunkSize := int64(models.TCP_BUFFER_SIZE / 2)
+	for i, blockHash := range remote.Blocks {
+		if i < len(local.Blocks) && bytes.Equal(local.Blocks[i], blockHash) {
+			continue
+		}
+		start := int64(i) * remote.BlockSize
+		end := start + remote.BlockSize
+		if end > size {
+			end = size
+		}
+		if len(chunkRanges) == 0 {
+			chunkRanges = []int64{chunkSize}
+		}
+		chunkRanges = append(chunkRanges, start, (end-start+chunkSize-1)/chunkSize)
+	}
+	return
+}
@@ -0,0 +1,218 @@
+package croc
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/schollz/logger"
+
+	"github.com/schollz/croc/v8/src/crypt"
+)
+
+// After the PAKE the sender sends a salt with the highest version of the
+// key derivation it supports, and the recipient sends it back with the
+// version it chose, which is the highest that both support. A peer
+// without versions sends none, which is version 0.
+//
+// With version 0 the key of every message and chunk is derived from the
+// key of the PAKE with PBKDF2. From version 1 it is derived with HKDF into
+// a key of the messages and one of the data sent by each peer. The sender
+// sends the version it offered again once the keys are derived, so that
+// the recipient can tell if a relay downgraded it.
+//
+// From version 1 the sender also offers the ciphers of the data with the
+// salt, in order of preference, and the recipient sends back the one it
+// chose. AES-GCM is chosen when both peers have AES instructions, and
+// ChaCha20-Poly1305 otherwise, unless Options.Cipher is set. The ciphers
+// offered and chosen are part of the derivation of the keys, so the keys
+// differ if a relay changed them. The messages are always of AES-GCM.
+//
+// From version 2 the data of each data connection is encrypted by its own
+// crypt.Stream, with counters as nonces and a new key after the chunks or
+// bytes of Options.RekeyChunks and Options.RekeyBytes. The nonces of the
+// earlier versions are random.
+//
+// From version 3 the recipient creates the directories in the list of
+// files, so the sender lists all of them. Recipients of the earlier
+// versions create an empty file for each directory instead, so only the
+// directories that are empty are listed to them, and they receive them
+// as empty files.
+//
+// From version 4 the peers can confirm the verification codes of
+// Options.Verify, see verify.go. A peer with Options.Verify ends the
+// transfer with the earlier versions, which do not confirm them.
+const (
+	handshakeLegacy       = 0
+	handshakeHKDF         = 1
+	handshakeCounters     = 2
+	handshakeDirectories  = 3
+	handshakeVerification = 4
+	// handshakeVersion is the highest version supported
+	handshakeVersion = handshakeVerification
+)
+
+// chooseHandshake returns the version of the key derivation
+// to use with a sender that offers the offered version
+func chooseHandshake(offered int) int {
+	if offered > handshakeVersion {
+		return handshakeVersion
+	}
+	if offered < 0 {
+		return handshakeLegacy
+	}
+	return offered
+}
+
+// supportsCipher reports whether the cipher is supported
+func supportsCipher(c crypt.Cipher) bool {
+	for _, supported := range crypt.Ciphers {
+		if c == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// offeredCiphers returns the ciphers that the sender offers,
+// in order of preference
+func (c *Client) offeredCiphers() string {
+	if c.Options.Cipher != "" {
+		return string(c.Options.Cipher)
+	}
+	ciphers := []string{string(crypt.Preferred())}
+	for _, cipher := range crypt.Ciphers {
+		if cipher != crypt.Preferred() {
+			ciphers = append(ciphers, string(cipher))
+		}
+	}
+	return strings.Join(ciphers, ",")
+}
+
+// chooseCipher returns the cipher to use of those
+// offered by the sender, in order of preference
+func (c *Client) chooseCipher(offered string) (crypt.Cipher, error) {
+	var ciphers []crypt.Cipher
+	for _, cipher := range strings.Split(offered, ",") {
+		if supportsCipher(crypt.Cipher(cipher)) {
+			ciphers = append(ciphers, crypt.Cipher(cipher))
+		}
+	}
+	has := func(cipher crypt.Cipher) bool {
+		for _, c := range ciphers {
+			if c == cipher {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case c.Options.Cipher != "":
+		if !has(c.Options.Cipher) {
+			return "", fmt.Errorf("sender does not offer cipher '%s'", c.Options.Cipher)
+		}
+		return c.Options.Cipher, nil
+	case len(ciphers) == 0:
+		return "", fmt.Errorf("sender offers no supported cipher of '%s'", offered)
+	case ciphers[0] == crypt.AESGCM && crypt.HasAESHardware():
+		return crypt.AESGCM, nil
+	case has(crypt.ChaCha20Poly1305):
+		return crypt.ChaCha20Poly1305, nil
+	}
+	return ciphers[0], nil
+}
+
+// deriveKeys sets the keys of the session from the key of the PAKE
+// and the salt, with the version of the key derivation and the cipher
+// of the data chosen of those offered
+func (c *Client) deriveKeys(sessionKey, salt []byte, version int, offered string, cipher crypt.Cipher) (err error) {
+	var sendKey, receiveKey []byte
+	switch version {
+	case handshakeLegacy:
+		c.Key, _, err = crypt.New(sessionKey, salt)
+		if err != nil {
+			return
+		}
+		sendKey, receiveKey, cipher = c.Key, c.Key, crypt.AESGCM
+	case handshakeHKDF, handshakeCounters, handshakeDirectories, handshakeVerification:
+		var keys crypt.SessionKeys
+		info := fmt.Sprintf("v%d %s %s", version, offered, cipher)
+		keys, err = crypt.NewSessionKeys(sessionKey, salt, []byte(info))
+		if err != nil {
+			return
+		}
+		c.Key = keys.Control
+		if c.Options.IsSender {
+			sendKey, receiveKey = keys.SenderData, keys.RecipientData
+		} else {
+			sendKey, receiveKey = keys.RecipientData, keys.SenderData
+		}
+	default:
+		return fmt.Errorf("unknown key derivation version %d", version)
+	}
+	if c.sendAEAD, err = crypt.NewAEAD(cipher, sendKey); err != nil {
+		return
+	}
+	if c.receiveAEAD, err = crypt.NewAEAD(cipher, receiveKey); err != nil {
+		return
+	}
+	c.sendKey, c.receiveKey = sendKey, receiveKey
+	c.sendStreams = make(map[int]*crypt.Stream)
+	c.receiveStreams = make(map[int]*crypt.Stream)
+	c.handshakeVersion = version
+	c.dataCipher = cipher
+	log.Debugf("derived keys with version %d for %s", version, cipher)
+	return
+}
+
+// dataStream returns the stream of the i-th data connection of the
+// streams, with its first key derived from the key
+func (c *Client) dataStream(streams map[int]*crypt.Stream, key []byte, i int) (s *crypt.Stream, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	s, ok := streams[i]
+	if ok {
+		return
+	}
+	s, err = crypt.NewStream(c.dataCipher, key, uint32(i), crypt.Limits{
+		Messages: uint64(c.Options.RekeyChunks),
+		Bytes:    uint64(c.Options.RekeyBytes),
+	})
+	if err != nil {
+		return
+	}
+	streams[i] = s
+	return
+}
+
+// sealData encrypts data sent over the i-th data connection
+func (c *Client) sealData(i int, plaintext, associatedData []byte) ([]byte, error) {
+	if c.handshakeVersion < handshakeCounters {
+		return crypt.Seal(c.sendAEAD, plaintext, associatedData)
+	}
+	s, err := c.dataStream(c.sendStreams, c.sendKey, i)
+	if err != nil {
+		return nil, err
+	}
+	return s.Seal(plaintext, associatedData)
+}
+
+// openData decrypts data received over the i-th data connection
+func (c *Client) openData(i int, encrypted, associatedData []byte) ([]byte, error) {
+	if c.handshakeVersion < handshakeCounters {
+		return crypt.Open(c.receiveAEAD, encrypted, associatedData)
+	}
+	s, err := c.dataStream(c.receiveStreams, c.receiveKey, i)
+	if err != nil {
+		return nil, err
+	}
+	return s.Open(encrypted, associatedData)
+}
+
+// checkHandshake checks the version that the sender offered,
+// as it is sent again once the keys are derived
+func (c *Client) checkHandshake(offered int) error {
+	if chooseHandshake(offered) != c.handshakeVersion {
+		return fmt.Errorf("key derivation was downgraded from version %d to %d", offered, c.handshakeVersion)
+	}
+	return nil
+}
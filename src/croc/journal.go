@@ -0,0 +1,208 @@
+package croc
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	log "github.com/schollz/logger"
+
+	"github.com/schollz/croc/v8/src/models"
+)
+
+// journalSaveInterval is how often the journal is saved while receiving
+const journalSaveInterval = 1 * time.Second
+
+// journal records the progress of receiving a set of files so that
+// an interrupted transfer of the same files can be resumed
+// exactly. It is saved beside the received files and removed once
+// the transfer succeeds.
+type journal struct {
+	path      string
+	lastSaved time.Time
+
+	Files []journalFile `json:"files"`
+}
+
+// journalFile is the identity of a file and which
+// of its bytes are already received
+type journalFile struct {
+	Name         string    `json:"n"`
+	FolderRemote string    `json:"fr"`
+	Size         int64     `json:"s"`
+	Hash         []byte    `json:"h"`
+	ModTime      time.Time `json:"m"`
+	Finished     bool      `json:"f,omitempty"`
+	// ReceivedAs is the name the file is received as if it was renamed
+	ReceivedAs string `json:"ra,omitempty"`
+	// Received are the sorted, non-overlapping [start, end) byte ranges received
+	Received [][2]int64 `json:"r,omitempty"`
+}
+
+func newJournalFile(fi FileInfo) journalFile {
+	return journalFile{
+		Name:         fi.Name,
+		FolderRemote: fi.FolderRemote,
+		Size:         fi.Size,
+		Hash:         fi.Hash,
+		ModTime:      fi.ModTime,
+	}
+}
+
+func (jf journalFile) sameFile(other journalFile) bool {
+	return jf.Name == other.Name &&
+		jf.FolderRemote == other.FolderRemote &&
+		jf.Size == other.Size &&
+		string(jf.Hash) == string(other.Hash) &&
+		jf.ModTime.Equal(other.ModTime)
+}
+
+// journalPath returns the path of the journal for a set of files
+func journalPath(files []FileInfo) string {
+	h := sha256.New()
+	for _, fi := range files {
+		b, _ := json.Marshal(newJournalFile(fi))
+		h.Write(b)
+	}
+	return fmt.Sprintf(".croc-%x.journal", h.Sum(nil)[:8])
+}
+
+// loadJournal returns the journal for a set of files, keeping
+// the progress of any previous attempt to receive them
+func loadJournal(files []FileInfo) (j *journal) {
+	j = &journal{
+		path:  journalPath(files),
+		Files: make([]journalFile, len(files)),
+	}
+	for i, fi := range files {
+		j.Files[i] = newJournalFile(fi)
+	}
+	b, err := ioutil.ReadFile(j.path)
+	if err != nil {
+		return
+	}
+	var previous journal
+	if err = json.Unmarshal(b, &previous); err != nil {
+		log.Debugf("ignoring journal %s: %v", j.path, err)
+		return
+	}
+	if len(previous.Files) != len(j.Files) {
+		return
+	}
+	for i := range j.Files {
+		if j.Files[i].sameFile(previous.Files[i]) {
+			j.Files[i] = previous.Files[i]
+		}
+	}
+	log.Debugf("resuming from journal %s", j.path)
+	return
+}
+
+// save writes the journal to disk
+func (j *journal) save() (err error) {
+	b, err := json.Marshal(j)
+	if err != nil {
+		return
+	}
+	tmp := j.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return
+	}
+	j.lastSaved = time.Now()
+	return os.Rename(tmp, j.path)
+}
+
+// remove deletes the journal from disk
+func (j *journal) remove() {
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		log.Debugf("could not remove journal: %v", err)
+	}
+}
+
+// finish marks the i-th file as received
+func (j *journal) finish(i int) {
+	j.Files[i].Finished = true
+	j.Files[i].Received = nil
+}
+
+// reset forgets anything received for the i-th file
+func (j *journal) reset(i int) {
+	j.Files[i].Finished = false
+	j.Files[i].Received = nil
+}
+
+// add records that the bytes [start, end) of the i-th file are received
+func (j *journal) add(i int, start, end int64) {
+	received := j.Files[i].Received
+	// find the first range that ends at or after start
+	k := sort.Search(len(received), func(k int) bool {
+		return received[k][1] >= start
+	})
+	// merge all ranges that overlap or touch [start, end)
+	l := k
+	for l < len(received) && received[l][0] <= end {
+		if received[l][0] < start {
+			start = received[l][0]
+		}
+		if received[l][1] > end {
+			end = received[l][1]
+		}
+		l++
+	}
+	merged := append([][2]int64{}, received[:k]...)
+	merged = append(merged, [2]int64{start, end})
+	j.Files[i].Received = append(merged, received[l:]...)
+}
+
+// limit forgets anything received of the i-th file past size
+func (j *journal) limit(i int, size int64) {
+	var received [][2]int64
+	for _, r := range j.Files[i].Received {
+		if r[0] >= size {
+			break
+		}
+		if r[1] > size {
+			r[1] = size
+		}
+		received = append(received, r)
+	}
+	j.Files[i].Received = received
+}
+
+// complete reports whether all bytes of the i-th file are received
+func (j *journal) complete(i int) bool {
+	jf := j.Files[i]
+	return jf.Finished || (len(jf.Received) == 1 && jf.Received[0][0] == 0 && jf.Received[0][1] >= jf.Size)
+}
+
+// missingChunkRanges returns the chunks of the i-th file that are not
+// received in the format of RemoteFileRequest.CurrentFileChunkRanges,
+// which is empty if nothing was received yet. It is only meaningful
+// if the file is not complete.
+func (j *journal) missingChunkRanges(i int) (chunkRanges []int64) {
+	jf := j.Files[i]
+	if len(jf.Received) == 0 {
+		return
+	}
+	chunkSize := int64(models.TCP_BUFFER_SIZE / 2)
+	chunkRanges = []int64{chunkSize}
+	addGap := func(start, end int64) {
+		if start >= end {
+			return
+		}
+		first := start / chunkSize * chunkSize
+		count := (end - first + chunkSize - 1) / chunkSize
+		chunkRanges = append(chunkRanges, first, count)
+	}
+	pos := int64(0)
+	for _, r := range jf.Received {
+		addGap(pos, r[0])
+		pos = r[1]
+	}
+	addGap(pos, jf.Size)
+	return
+}
@@ -0,0 +1,335 @@
+package croc
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/denisbrodbeck/machineid"
+	"github.com/schollz/progressbar/v3"
+
+	"github.com/schollz/croc/v8/src/models"
+	"github.com/schollz/croc/v8/src/utils"
+)
+
+// EventType is the kind of event reported to an Observer
+type EventType int
+
+const (
+	// EventConnected is reported when the relay room with the peer is joined
+	EventConnected EventType = iota
+	// EventPeerJoined is reported when the channel with the peer is secured
+	EventPeerJoined
+	// EventManifest is reported when the list of files to transfer is known
+	EventManifest
+	// EventFileStarted is reported when a file begins transferring
+	EventFileStarted
+	// EventFileProgress is reported when bytes of the current file are transferred
+	EventFileProgress
+	// EventFileFinished is reported when a file is done transferring
+	EventFileFinished
+	// EventTransferDone is reported when the whole transfer succeeded
+	EventTransferDone
+	// EventError is reported when the transfer ends with an error
+	EventError
+	// EventFileExists is reported when a file to receive already exists
+	EventFileExists
+	// EventFileSkipped is reported when a file is not received because
+	// a different file already exists in its place
+	EventFileSkipped
+	// EventFileRenamed is reported when a file is received under a new
+	// name because a different file already exists in its place
+	EventFileRenamed
+	// EventVerification is reported when the channel with the peer is
+	// secured, with the code that the user can compare with the peer
+	EventVerification
+	// EventCodeReady is reported when the sender is ready for the
+	// recipient, with the code that it receives with
+	EventCodeReady
+	// EventConnecting is reported when the recipient starts to look
+	// for the sender
+	EventConnecting
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventConnected:
+		return "connected"
+	case EventPeerJoined:
+		return "peer joined"
+	case EventManifest:
+		return "manifest"
+	case EventFileStarted:
+		return "file started"
+	case EventFileProgress:
+		return "file progress"
+	case EventFileFinished:
+		return "file finished"
+	case EventTransferDone:
+		return "transfer done"
+	case EventError:
+		return "error"
+	case EventFileExists:
+		return "file exists"
+	case EventFileSkipped:
+		return "file skipped"
+	case EventFileRenamed:
+		return "file renamed"
+	case EventVerification:
+		return "verification"
+	case EventCodeReady:
+		return "code ready"
+	case EventConnecting:
+		return "connecting"
+	}
+	return fmt.Sprintf("event(%d)", int(t))
+}
+
+// Event is reported to an Observer as a transfer progresses
+type Event struct {
+	Type EventType
+	// Files is the manifest of the transfer
+	Files []FileInfo
+	// FileIndex and File refer to the file the event is about
+	FileIndex int
+	File      FileInfo
+	// Bytes is the number of bytes transferred for EventFileProgress
+	// and the number of bytes already present for EventFileStarted
+	Bytes int64
+	// NewName is the name the file is received as for EventFileRenamed
+	NewName string
+	// Address is the relay (EventConnected) or peer (EventPeerJoined) address
+	Address string
+	// Code is the verification code for EventVerification and
+	// the code to receive with for EventCodeReady
+	Code string
+	// Err is set for EventError
+	Err error
+}
+
+// Observer receives the events of a transfer. OnEvent may be called
+// from multiple goroutines.
+type Observer interface {
+	OnEvent(e Event)
+}
+
+// ObserverFunc lets an ordinary function be used as an Observer
+type ObserverFunc func(e Event)
+
+// OnEvent calls f(e)
+func (f ObserverFunc) OnEvent(e Event) {
+	f(e)
+}
+
+func (c *Client) emit(e Event) {
+	if c.observer == nil {
+		return
+	}
+	if e.Files == nil {
+		e.Files = c.FilesToTransfer
+	}
+	c.observer.OnEvent(e)
+}
+
+// describeFiles returns the name used to present a set of files and their total size
+func describeFiles(files []FileInfo, sendingText bool) (fname string, totalSize int64) {
+	numFiles, numFolders := countFiles(files)
+	fname = fmt.Sprintf("%d files", numFiles)
+	if numFolders > 0 {
+		fname = fmt.Sprintf("%d files and %d folders", numFiles, numFolders)
+	}
+	if len(files) == 1 {
+		fname = fmt.Sprintf("'%s'", files[0].Name)
+	}
+	if strings.HasPrefix(fname, "'croc-stdin-") {
+		fname = "'stdin'"
+		if sendingText {
+			fname = "'text'"
+		}
+	}
+	for _, fi := range files {
+		totalSize += fi.Size
+	}
+	return
+}
+
+// countFiles returns the number of files and folders in a manifest
+func countFiles(files []FileInfo) (numFiles, numFolders int) {
+	for _, fi := range files {
+		if fi.IsDir {
+			numFolders++
+		} else {
+			numFiles++
+		}
+	}
+	return
+}
+
+// progressBarObserver is the default Observer which
+// renders the transfer as progress bars on stderr.
+// Files that are sent at once are shown one after the other.
+type progressBarObserver struct {
+	c               *Client
+	mutex           sync.Mutex
+	bar             *progressbar.ProgressBar
+	barIndex        int
+	barActive       bool
+	queued          []Event
+	pending         map[int]int64
+	finished        map[int]bool
+	longestFilename int
+	finishedNum     int
+	started         bool
+	skipped         []string
+	renamed         []string
+}
+
+func newProgressBarObserver(c *Client) *progressBarObserver {
+	return &progressBarObserver{
+		c:        c,
+		pending:  make(map[int]int64),
+		finished: make(map[int]bool),
+	}
+}
+
+func (o *progressBarObserver) OnEvent(e Event) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	switch e.Type {
+	case EventCodeReady:
+		flags := &strings.Builder{}
+		if o.c.Options.RelayAddress != models.DEFAULT_RELAY {
+			flags.WriteString("--relay " + o.c.Options.RelayAddress + " ")
+		}
+		if o.c.Options.RelayPassword != models.DEFAULT_PASSPHRASE {
+			flags.WriteString("--pass " + o.c.Options.RelayPassword + " ")
+		}
+		fmt.Fprintf(os.Stderr, "Code is: %[1]s\nOn the other computer run\n\ncroc %[2]s%[1]s\n", e.Code, flags.String())
+		if o.c.Options.Ask {
+			machid, _ := machineid.ID()
+			fmt.Fprintf(os.Stderr, "\rYour machine ID is '%s'\n", machid)
+		}
+	case EventConnecting:
+		fmt.Fprintf(os.Stderr, "connecting...")
+	case EventConnected:
+		if !o.c.Options.IsSender {
+			fmt.Fprintf(os.Stderr, "\rsecuring channel...")
+		}
+	case EventVerification:
+		fmt.Fprintf(os.Stderr, "\rVerification code is '%s'\n", e.Code)
+	case EventManifest:
+		for _, fi := range e.Files {
+			if len(fi.Name) > o.longestFilename {
+				o.longestFilename = len(fi.Name)
+			}
+		}
+		fname, totalSize := describeFiles(e.Files, o.c.Options.SendingText)
+		if o.c.Options.IsSender {
+			fmt.Fprintf(os.Stderr, "Sending %s (%s)\n", fname, utils.ByteCountDecimal(totalSize))
+		} else if o.c.Options.NoPrompt && !o.c.Options.Ask {
+			fmt.Fprintf(os.Stderr, "\rReceiving %s (%s) \n", fname, utils.ByteCountDecimal(totalSize))
+		}
+	case EventFileStarted:
+		if !o.started {
+			o.started = true
+			if o.c.Options.IsSender {
+				fmt.Fprintf(os.Stderr, "\nSending (->%s)\n", o.c.ExternalIPConnected)
+			} else {
+				fmt.Fprintf(os.Stderr, "\nReceiving (<-%s)\n", o.c.ExternalIPConnected)
+			}
+		}
+		if o.barActive && e.FileIndex != o.barIndex {
+			o.queued = append(o.queued, e)
+			return
+		}
+		o.newBar(e)
+	case EventFileProgress:
+		if o.barActive && e.FileIndex != o.barIndex {
+			o.pending[e.FileIndex] += e.Bytes
+		} else if o.bar != nil {
+			o.bar.Add64(e.Bytes)
+		}
+	case EventFileFinished:
+		if o.barActive && e.FileIndex != o.barIndex {
+			o.finished[e.FileIndex] = true
+			return
+		}
+		if o.bar != nil {
+			o.bar.Finish()
+		}
+		o.barActive = false
+		o.nextBar()
+	case EventFileExists:
+		fmt.Fprintf(os.Stderr, "\r'%s' already exists\n", path.Join(e.File.FolderRemote, e.File.Name))
+	case EventFileSkipped:
+		o.skipped = append(o.skipped, path.Join(e.File.FolderRemote, e.File.Name))
+	case EventFileRenamed:
+		o.renamed = append(o.renamed, fmt.Sprintf("%s -> %s",
+			path.Join(e.File.FolderRemote, e.File.Name), path.Join(e.File.FolderRemote, e.NewName)))
+	case EventError:
+		fmt.Fprint(os.Stderr, "\r")
+	case EventTransferDone:
+		if len(o.skipped) > 0 {
+			fmt.Fprintf(os.Stderr, "Skipped files that already exist:\n  %s\n", strings.Join(o.skipped, "\n  "))
+		}
+		if len(o.renamed) > 0 {
+			fmt.Fprintf(os.Stderr, "Renamed files that already exist:\n  %s\n", strings.Join(o.renamed, "\n  "))
+		}
+	}
+}
+
+func (o *progressBarObserver) newBar(e Event) {
+	description := fmt.Sprintf("%-*s", o.longestFilename, e.File.Name)
+	numFiles, _ := countFiles(e.Files)
+	if numFiles == 1 {
+		description = e.File.Name
+	}
+	size := e.File.Size
+	if e.File.IsStream {
+		// the length of a stream is not known
+		size = -1
+	} else if size == 0 {
+		size = 1
+	}
+	o.bar = progressbar.NewOptions64(size,
+		progressbar.OptionOnCompletion(func() {
+			o.finishedNum++
+			if numFiles > 1 {
+				fmt.Fprintf(os.Stderr, " %d/%d\n", o.finishedNum, numFiles)
+			}
+		}),
+		progressbar.OptionSetWidth(20),
+		progressbar.OptionSetDescription(description),
+		progressbar.OptionSetRenderBlankState(true),
+		progressbar.OptionShowBytes(true),
+		progressbar.OptionShowCount(),
+		progressbar.OptionSetWriter(os.Stderr),
+		progressbar.OptionThrottle(100*time.Millisecond),
+		progressbar.OptionSetVisibility(!o.c.Options.SendingText),
+	)
+	if e.Bytes > 0 {
+		o.bar.Add64(e.Bytes)
+	}
+	o.barIndex = e.FileIndex
+	// a file that is already there is not finished
+	o.barActive = e.File.IsStream || e.Bytes < e.File.Size
+}
+
+// nextBar shows the files that started while another was shown
+func (o *progressBarObserver) nextBar() {
+	for len(o.queued) > 0 && !o.barActive {
+		e := o.queued[0]
+		o.queued = o.queued[1:]
+		e.Bytes += o.pending[e.FileIndex]
+		delete(o.pending, e.FileIndex)
+		o.newBar(e)
+		if o.finished[e.FileIndex] {
+			delete(o.finished, e.FileIndex)
+			o.bar.Finish()
+			o.barActive = false
+		}
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package croc
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileOwner returns the user and group that own a file
+func fileOwner(fstats os.FileInfo) (uid, gid int) {
+	if stat, ok := fstats.Sys().(*syscall.Stat_t); ok {
+		uid, gid = int(stat.Uid), int(stat.Gid)
+	}
+	return
+}
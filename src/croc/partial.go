@@ -0,0 +1,46 @@
+package croc
+
+import (
+	"io"
+	"os"
+
+	log "github.com/schollz/logger"
+)
+
+// partialSuffix is added to the name of a file while it is received
+const partialSuffix = ".croc-partial"
+
+// partialPath returns the path a file is received at until it is complete
+func partialPath(pathToFile string) string {
+	return pathToFile + partialSuffix
+}
+
+// finishPartialFile gives a received file its final name, if it
+// was received under a partial name
+func finishPartialFile(pathToFile string) (err error) {
+	pathToPartial := partialPath(pathToFile)
+	if _, err = os.Stat(pathToPartial); os.IsNotExist(err) {
+		// the file was verified in place
+		return nil
+	}
+	log.Debugf("renaming %s to %s", pathToPartial, pathToFile)
+	return os.Rename(pathToPartial, pathToFile)
+}
+
+// copyFile copies the content of src to a new file dst
+func copyFile(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return
+	}
+	return out.Close()
+}
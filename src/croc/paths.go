@@ -0,0 +1,186 @@
+package croc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// SymlinkPolicy is which symlinks a recipient accepts
+type SymlinkPolicy string
+
+const (
+	// SymlinkInside accepts symlinks that point inside the folder
+	// receiving the files, which is the default
+	SymlinkInside SymlinkPolicy = "inside"
+	// SymlinkRefuse refuses any files that include a symlink
+	SymlinkRefuse SymlinkPolicy = "refuse"
+	// SymlinkAllow accepts symlinks that point anywhere and
+	// lets files be received through existing symlinks
+	SymlinkAllow SymlinkPolicy = "allow"
+)
+
+// ErrUnsafePath is returned when a file would be
+// received outside of the folder receiving the files
+var ErrUnsafePath = errors.New("unsafe path")
+
+func unsafePath(p, reason string) error {
+	return fmt.Errorf("%w '%s': %s", ErrUnsafePath, p, reason)
+}
+
+// isAbs reports whether p is absolute for either the sender or the recipient
+func isAbs(p string) bool {
+	return path.IsAbs(p) || filepath.IsAbs(p) || filepath.VolumeName(p) != ""
+}
+
+// validateManifest checks that the files of a sender stay inside the
+// folder receiving them and that their symlinks follow the policy.
+// FolderRemote of each file is normalized.
+func validateManifest(files []FileInfo, policy SymlinkPolicy) (err error) {
+	symlinks := make(map[string]string)
+	for i := range files {
+		fi := &files[i]
+		if fi.Name == "" || fi.Name == "." || fi.Name == ".." ||
+			strings.ContainsAny(fi.Name, "/\x00") ||
+			(runtime.GOOS == "windows" && strings.ContainsAny(fi.Name, `\:`)) {
+			return unsafePath(fi.Name, "invalid name")
+		}
+		folder := fi.FolderRemote
+		if folder == "" {
+			folder = "."
+		}
+		if strings.ContainsRune(folder, 0) ||
+			(runtime.GOOS == "windows" && strings.ContainsRune(folder, '\\')) {
+			return unsafePath(folder, "invalid folder")
+		}
+		if isAbs(folder) {
+			return unsafePath(path.Join(folder, fi.Name), "absolute path")
+		}
+		folder = path.Clean(folder)
+		if folder == ".." || strings.HasPrefix(folder, "../") {
+			return unsafePath(path.Join(folder, fi.Name), "outside of the output folder")
+		}
+		fi.FolderRemote = folder
+		pathToFile := path.Join(folder, fi.Name)
+
+		// nothing may be received through a symlink of the same transfer
+		for dir := folder; dir != "."; dir = path.Dir(dir) {
+			if _, ok := symlinks[dir]; ok {
+				return unsafePath(pathToFile, "inside a symlink")
+			}
+		}
+
+		if fi.Symlink == "" {
+			continue
+		}
+		target := filepath.ToSlash(fi.Symlink)
+		symlinks[pathToFile] = target
+		switch policy {
+		case SymlinkAllow:
+		case SymlinkRefuse:
+			return unsafePath(pathToFile, "symlinks are refused")
+		default:
+			if isAbs(target) {
+				return unsafePath(pathToFile, "symlink to an absolute path")
+			}
+		}
+	}
+	if policy == SymlinkAllow {
+		return
+	}
+
+	// the targets are checked once all the symlinks are known, as
+	// a symlink may point through another one created after it
+	for _, fi := range files {
+		if fi.Symlink == "" {
+			continue
+		}
+		pathToFile := path.Join(fi.FolderRemote, fi.Name)
+		if leavesRoot(path.Dir(pathToFile)+"/"+symlinks[pathToFile], symlinks) {
+			return unsafePath(pathToFile, "symlink outside of the output folder")
+		}
+	}
+	return
+}
+
+// maxSymlinkHops is how many symlinks leavesRoot follows
+// before it gives up on a path, like ELOOP
+const maxSymlinkHops = 40
+
+// leavesRoot reports whether p, which is relative to the folder receiving
+// the files, leaves it once the symlinks of the manifest are followed.
+// Each ".." applies to where the path points so far, as on disk, rather
+// than being cleaned away first.
+func leavesRoot(p string, symlinks map[string]string) bool {
+	pending := strings.Split(p, "/")
+	current := "."
+	hops := 0
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if current == "." {
+				return true
+			}
+			current = path.Dir(current)
+			continue
+		}
+		current = path.Join(current, part)
+		target, ok := symlinks[current]
+		if !ok {
+			continue
+		}
+		hops++
+		if hops > maxSymlinkHops {
+			return true
+		}
+		current = path.Dir(current)
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+	return false
+}
+
+// checkInsideRoot checks that writing to p, which is relative to the
+// current directory, does not leave it through an existing symlink
+func checkInsideRoot(p string) (err error) {
+	root, err := os.Getwd()
+	if err != nil {
+		return
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return
+	}
+	// resolve the deepest part of the path that exists
+	existing := filepath.Clean(p)
+	for {
+		if _, errStat := os.Lstat(existing); errStat == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		existing = parent
+	}
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return unsafePath(p, "unresolvable symlink")
+	}
+	resolved, err = filepath.Abs(resolved)
+	if err != nil {
+		return
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return unsafePath(p, "outside of the output folder")
+	}
+	return nil
+}
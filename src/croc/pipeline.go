@@ -0,0 +1,236 @@
+package croc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	log "github.com/schollz/logger"
+
+	"github.com/schollz/croc/v8/src/message"
+	"github.com/schollz/croc/v8/src/utils"
+)
+
+// Files that are not bundled are requested several at once in a
+// pipeline, so that the data connections do not wait between files. Each
+// data connection sends its chunks of the files of the pipeline one file
+// after the other, and starts on the next file without waiting for the
+// other connections to finish the previous one. Their chunks carry the
+// index of their file after the position. Once the recipient has all of
+// them, the sender sends the digest of each file.
+
+// pipelineMaxFiles limits the files of a pipeline
+const pipelineMaxFiles = 16
+
+// PipelineFile is a file requested as part of a pipeline
+type PipelineFile struct {
+	Index int `json:"i"`
+	// ChunkRanges are the chunks requested, in the format of
+	// RemoteFileRequest.CurrentFileChunkRanges
+	ChunkRanges []int64 `json:"r,omitempty"`
+}
+
+// pipelinedFile is the state of a file of a pipeline
+type pipelinedFile struct {
+	// chunkMap is the chunks left to send, nil for all of them
+	chunkMap map[uint64]struct{}
+	// sent is the number of data connections done sending the file
+	sent int32
+
+	// file is where the file is received
+	file *os.File
+	// chunks is the number of chunks requested, 0 for all of them
+	chunks         int
+	received       int64
+	receivedChunks int
+	done           bool
+}
+
+// pipelineable reports whether the i-th file can be received in a pipeline
+func (c *Client) pipelineable(i int) bool {
+	if _, alone := c.receiveAlone[i]; alone {
+		return false
+	}
+	fi := c.FilesToTransfer[i]
+	// sinks create one file at a time
+	return c.pipelining && c.sink == nil && !c.rerequest &&
+		fi.Size > 0 && !fi.IsDir && !fi.IsStream && fi.Symlink == ""
+}
+
+// recipientInitializePipeline opens the files of the pipeline
+func (c *Client) recipientInitializePipeline() (err error) {
+	c.pipelineFiles = make(map[int]*pipelinedFile)
+	c.pipelineDone = 0
+	c.CurrentFileChunks = []int64{}
+	c.CurrentFileChunkRanges = []int64{}
+	for k, entry := range c.pipeline {
+		c.FilesToTransferCurrentNum = entry.Index
+		c.verifyOnly = false
+		c.rerequest = false
+		if err = c.recipientInitializeFile(); err != nil {
+			return
+		}
+		c.pipeline[k].ChunkRanges = c.CurrentFileChunkRanges
+		c.CurrentFileChunks = utils.ChunkRangesToChunks(c.CurrentFileChunkRanges)
+		c.pipelineFiles[entry.Index] = &pipelinedFile{
+			file:   c.CurrentFile,
+			chunks: len(c.CurrentFileChunks),
+		}
+		c.emitFileStarted()
+	}
+	c.FilesToTransferCurrentNum = c.pipeline[0].Index
+	c.CurrentFile = nil
+	c.CurrentFileChunks = []int64{}
+	c.CurrentFileChunkRanges = []int64{}
+	return
+}
+
+// receivePipelineData writes a chunk of a file of the pipeline
+func (c *Client) receivePipelineData(data []byte) (err error) {
+	if len(data) < 12 {
+		return &TransferError{Op: "decode", Err: fmt.Errorf("chunk too short")}
+	}
+	pos := int64(binary.LittleEndian.Uint64(data[:8]))
+	index := int(binary.LittleEndian.Uint32(data[8:12]))
+	data = data[12:]
+	c.mutex.Lock()
+	pf, ok := c.pipelineFiles[index]
+	if !ok || pf.done {
+		c.mutex.Unlock()
+		return &TransferError{Op: "decode", Err: fmt.Errorf("chunk of file %d is not requested", index)}
+	}
+	fi := c.FilesToTransfer[index]
+	_, err = pf.file.WriteAt(data, pos)
+	if err == nil && c.journal != nil {
+		c.journal.add(index, pos, pos+int64(len(data)))
+		c.saveJournal(false)
+	}
+	c.mutex.Unlock()
+	if err != nil {
+		return &TransferError{Op: "write", File: fi.Name, Err: err}
+	}
+	// the progress is reported before the chunk is counted, so that
+	// it is reported before the pipeline is done
+	c.emit(Event{Type: EventFileProgress, FileIndex: index, File: fi, Bytes: int64(len(data))})
+
+	c.mutex.Lock()
+	pf.received += int64(len(data))
+	pf.receivedChunks++
+	c.TotalSent += int64(len(data))
+	done := pf.receivedChunks == pf.chunks || pf.received == fi.Size
+	if done {
+		pf.done = true
+		c.pipelineDone++
+	}
+	allDone := c.pipelineDone == len(c.pipelineFiles)
+	c.mutex.Unlock()
+	if !done {
+		return
+	}
+
+	log.Debugf("finished receiving %s", fi.Name)
+	c.emit(Event{Type: EventFileFinished, FileIndex: index, File: fi})
+	c.mutex.Lock()
+	file := pf.file
+	if errSync := file.Sync(); errSync != nil {
+		log.Debugf("error syncing %s: %v", file.Name(), errSync)
+	}
+	c.saveJournal(true)
+	pf.file = nil
+	c.mutex.Unlock()
+	if errClose := file.Close(); errClose != nil {
+		log.Errorf("error closing %s: %v", file.Name(), errClose)
+	}
+	if !allDone {
+		return
+	}
+	if c.tuner != nil {
+		c.tuner.finish()
+	}
+	log.Debug("sending close-sender")
+	if err = message.Send(c.conn[0], c.Key, message.Message{Type: "close-sender"}); err != nil {
+		return &TransferError{Op: "send", Err: err}
+	}
+	return
+}
+
+// recipientVerifyPipeline checks the files of the pipeline
+// against their digests from the sender
+func (c *Client) recipientVerifyPipeline(b []byte) (err error) {
+	files := make([]BundleFile, len(c.pipeline))
+	for k, entry := range c.pipeline {
+		files[k] = BundleFile{Index: entry.Index}
+	}
+	c.pipeline = nil
+	c.pipelineFiles = nil
+	return c.recipientVerifyBatch(b, files)
+}
+
+// senderInitializePipeline prepares to send the files of a pipeline
+// requested by the recipient
+func (c *Client) senderInitializePipeline(pipeline []PipelineFile) (err error) {
+	c.pipeline = nil
+	if len(pipeline) == 0 {
+		return
+	}
+	pipelineFiles := make(map[int]*pipelinedFile)
+	for _, entry := range pipeline {
+		if entry.Index < 0 || entry.Index >= len(c.FilesToTransfer) ||
+			c.FilesToTransfer[entry.Index].IsStream || c.FilesToTransfer[entry.Index].IsDir {
+			return fmt.Errorf("can not send file %d at once with others", entry.Index)
+		}
+		if _, ok := pipelineFiles[entry.Index]; ok {
+			return fmt.Errorf("file %d is requested twice", entry.Index)
+		}
+		if err = checkChunkRanges(entry.ChunkRanges); err != nil {
+			return
+		}
+		pf := &pipelinedFile{}
+		chunks := utils.ChunkRangesToChunks(entry.ChunkRanges)
+		if len(chunks) > 0 {
+			pf.chunkMap = make(map[uint64]struct{})
+			for _, chunk := range chunks {
+				pf.chunkMap[uint64(chunk)] = struct{}{}
+			}
+		}
+		pipelineFiles[entry.Index] = pf
+	}
+	c.pipeline = pipeline
+	c.pipelineFiles = pipelineFiles
+	return
+}
+
+// sendPipelineData sends the chunks of each file of the pipeline
+// that the i-th data connection sends
+func (c *Client) sendPipelineData(i int) {
+	pipeline := c.pipeline
+	var digests []*FileDigest
+	if i == 0 {
+		digests = make([]*FileDigest, len(pipeline))
+		defer func() {
+			c.batchDigestchan <- digests
+		}()
+	}
+	for k, entry := range pipeline {
+		fi := c.FilesToTransfer[entry.Index]
+		pf := c.pipelineFiles[entry.Index]
+		if i == 0 {
+			c.emit(Event{Type: EventFileStarted, FileIndex: entry.Index, File: fi})
+		}
+		digest, err := c.sendFile(i, entry.Index, pf.chunkMap, c.chunkSizeOf(entry.ChunkRanges), true)
+		if err != nil {
+			if c.ctx.Err() == nil {
+				c.dataError(err)
+			}
+			return
+		}
+		if i == 0 {
+			digests[k] = digest
+		}
+		if int(atomic.AddInt32(&pf.sent, 1)) == c.streams {
+			c.emit(Event{Type: EventFileFinished, FileIndex: entry.Index, File: fi})
+		}
+	}
+	log.Debugf("finished with %d", i)
+}
@@ -0,0 +1,226 @@
+package croc
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"path"
+	"sync"
+
+	log "github.com/schollz/logger"
+)
+
+// Sink receives files instead of the current directory. Names are
+// slash separated, relative to the root of the sink and checked to
+// stay inside it, and any missing parents of a name are created by
+// the sink. Each is given the FileInfo the sender described it with,
+// such as its modification time and mode. Entries are created in the
+// order of the manifest and data is written to the files out of order.
+type Sink interface {
+	// Create returns a new file at name, replacing anything there,
+	// which is fileInfo.Size bytes long unless fileInfo.IsStream
+	Create(name string, fileInfo FileInfo) (SinkFile, error)
+	// Mkdir creates the directory at name
+	Mkdir(name string, fileInfo FileInfo) error
+	// Symlink creates name as a symlink to fileInfo.Symlink
+	Symlink(name string, fileInfo FileInfo) error
+	// Finalize is called once a file, directory or symlink
+	// is completely received and verified
+	Finalize(name string, fileInfo FileInfo) error
+}
+
+// SinkFile is a file being received into a Sink
+type SinkFile interface {
+	io.WriterAt
+	io.Closer
+}
+
+// stdoutSink writes the files it receives to w one after another
+type stdoutSink struct {
+	w io.Writer
+}
+
+func (s stdoutSink) Create(name string, fileInfo FileInfo) (SinkFile, error) {
+	return newReorderWriter(s.w), nil
+}
+
+func (stdoutSink) Mkdir(name string, fileInfo FileInfo) error {
+	return nil
+}
+
+func (stdoutSink) Symlink(name string, fileInfo FileInfo) error {
+	return nil
+}
+
+func (stdoutSink) Finalize(name string, fileInfo FileInfo) error {
+	return nil
+}
+
+// sinkInitializeFile creates the current file in the sink
+func (c *Client) sinkInitializeFile() (err error) {
+	fileInfo := c.FilesToTransfer[c.FilesToTransferCurrentNum]
+	sinkFile, err := c.sink.Create(path.Join(fileInfo.FolderRemote, fileInfo.Name), fileInfo)
+	if err != nil {
+		return
+	}
+	digest, ok := sinkFile.(*reorderWriter)
+	if !ok {
+		// the sink is not read back, so the digest is
+		// computed in order as the data is written
+		digest = newReorderWriter(ioutil.Discard)
+	}
+	c.mutex.Lock()
+	c.sinkFile = sinkFile
+	c.sinkDigest = digest
+	c.mutex.Unlock()
+	return
+}
+
+// writeSink writes data received for the current file to the sink
+func (c *Client) writeSink(p []byte, off int64) (err error) {
+	c.mutex.Lock()
+	sinkFile, digest := c.sinkFile, c.sinkDigest
+	c.mutex.Unlock()
+	if sinkFile == nil {
+		return errSinkClosed
+	}
+	if _, err = sinkFile.WriteAt(p, off); err != nil {
+		return
+	}
+	if digest != sinkFile {
+		_, err = digest.WriteAt(p, off)
+	}
+	return
+}
+
+// sinkCreateEmptyFile creates a file, directory or symlink
+// without any data in the sink
+func (c *Client) sinkCreateEmptyFile(fileInfo FileInfo, i int) (err error) {
+	pathToFile := path.Join(fileInfo.FolderRemote, fileInfo.Name)
+	if fileInfo.IsDir {
+		log.Debugf("creating directory %s in sink", pathToFile)
+		// it is finalized once everything in it is received
+		if err = c.sink.Mkdir(pathToFile, fileInfo); err == nil {
+			c.FilesHasFinished[i] = struct{}{}
+		}
+		return
+	} else if fileInfo.Symlink != "" {
+		log.Debugf("creating symlink %s in sink", pathToFile)
+		err = c.sink.Symlink(pathToFile, fileInfo)
+	} else {
+		log.Debugf("creating empty file %s in sink", pathToFile)
+		var f SinkFile
+		if f, err = c.sink.Create(pathToFile, fileInfo); err == nil {
+			err = f.Close()
+		}
+	}
+	if err != nil {
+		return
+	}
+	if err = c.sink.Finalize(pathToFile, fileInfo); err != nil {
+		return
+	}
+	c.emit(Event{Type: EventFileStarted, FileIndex: i, File: fileInfo})
+	c.emit(Event{Type: EventFileFinished, FileIndex: i, File: fileInfo})
+	return
+}
+
+// reorderBufferSize limits how much data received out of order is
+// kept while waiting for the data before it
+const reorderBufferSize = 16 << 20
+
+// errSinkClosed is returned when writing to a closed reorderWriter
+var errSinkClosed = errors.New("sink closed")
+
+// reorderWriter writes data that arrives at any offset to w in order.
+// Data received ahead of the next offset is buffered, and writers
+// wait while the buffer is full. Data already written is ignored.
+type reorderWriter struct {
+	w      io.Writer
+	digest *digester
+
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	next    int64
+	pending map[int64][]byte
+	size    int
+	closed  bool
+	err     error
+}
+
+func newReorderWriter(w io.Writer) *reorderWriter {
+	r := &reorderWriter{
+		w:       w,
+		digest:  newStreamDigester(),
+		pending: make(map[int64][]byte),
+	}
+	r.cond = sync.NewCond(&r.mutex)
+	return r
+}
+
+// WriteAt writes p at offset off once everything before it is written
+func (r *reorderWriter) WriteAt(p []byte, off int64) (n int, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for off > r.next && r.size+len(p) > reorderBufferSize && !r.closed && r.err == nil {
+		r.cond.Wait()
+	}
+	if r.closed {
+		return 0, errSinkClosed
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	if off < r.next {
+		// already written
+		return len(p), nil
+	}
+	if off > r.next {
+		r.pending[off] = append([]byte{}, p...)
+		r.size += len(p)
+		return len(p), nil
+	}
+	if err = r.write(p); err != nil {
+		return
+	}
+	for {
+		data, ok := r.pending[r.next]
+		if !ok {
+			break
+		}
+		delete(r.pending, r.next)
+		r.size -= len(data)
+		if err = r.write(data); err != nil {
+			return
+		}
+	}
+	r.cond.Broadcast()
+	return len(p), nil
+}
+
+func (r *reorderWriter) write(p []byte) (err error) {
+	if _, err = r.w.Write(p); err != nil {
+		r.err = err
+		r.cond.Broadcast()
+		return
+	}
+	r.digest.Write(p)
+	r.next += int64(len(p))
+	return
+}
+
+// Sum returns the digest of everything written in order
+func (r *reorderWriter) Sum() FileDigest {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.digest.Sum()
+}
+
+// Close stops any writers that are waiting
+func (r *reorderWriter) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.closed = true
+	r.cond.Broadcast()
+	return nil
+}
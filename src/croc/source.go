@@ -0,0 +1,73 @@
+package croc
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/schollz/croc/v8/src/utils"
+)
+
+// symlinkFS is a source that can describe symlinks
+// instead of the files they point to
+type symlinkFS interface {
+	fs.FS
+	Lstat(name string) (fs.FileInfo, error)
+	ReadLink(name string) (string, error)
+}
+
+// osSource is the source of files given by their path on disk
+type osSource struct{}
+
+func (osSource) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+func (osSource) Lstat(name string) (fs.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (osSource) ReadLink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
+// lstatSource returns the information of name in fsys,
+// without following it if it is a symlink
+func lstatSource(fsys fs.FS, name string) (fs.FileInfo, error) {
+	if l, ok := fsys.(symlinkFS); ok {
+		return l.Lstat(name)
+	}
+	return fs.Stat(fsys, name)
+}
+
+// readLinkSource returns the target of the symlink name in fsys
+func readLinkSource(fsys fs.FS, name string) (string, error) {
+	if l, ok := fsys.(symlinkFS); ok {
+		return l.ReadLink(name)
+	}
+	return "", fmt.Errorf("can not read symlink %s", name)
+}
+
+// hashSource returns the imohash of name in fsys
+func hashSource(fsys fs.FS, name string) (hash []byte, err error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return
+	}
+	return utils.IMOHashReader(f, stat.Size())
+}
+
+// digestSource computes the digest of name in fsys, which is size bytes
+func digestSource(fsys fs.FS, name string, size int64) (digest FileDigest, err error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	return digestReader(f, size)
+}
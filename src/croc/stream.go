@@ -0,0 +1,119 @@
+package croc
+
+import (
+	"io"
+	"math"
+
+	log "github.com/schollz/logger"
+)
+
+// streamEnd is set in the position of the chunk that ends a stream,
+// the rest of the position is the length of the stream
+const streamEnd = uint64(1) << 63
+
+// defaultStreamName is the name of a stream that is not given one,
+// which recipients replace with a name of their own
+const defaultStreamName = "croc-stdin-stream"
+
+// newStreamDigester returns a digester for content of unknown
+// length, which only has the digest of the full content
+func newStreamDigester() *digester {
+	d := newDigester(0)
+	d.blockSize = math.MaxInt64
+	return d
+}
+
+// sendStream sends the stream of the current file over the first
+// data connection. A stream is read only once, so its chunks are
+// sent in order and followed by a chunk that marks its end.
+func (c *Client) sendStream() {
+	var digest *FileDigest
+	defer func() {
+		c.digestchan <- digest
+	}()
+
+	d := newStreamDigester()
+	pos := uint64(0)
+	for {
+		if c.ctx.Err() != nil {
+			return
+		}
+		data := make([]byte, c.chunkSize)
+		n, errRead := io.ReadFull(c.stream, data)
+		if n > 0 {
+			d.Write(data[:n])
+			if err := c.sendChunk(0, c.FilesToTransferCurrentNum, pos, data[:n]); err != nil {
+				if c.ctx.Err() == nil {
+					c.dataError(err)
+				}
+				return
+			}
+			c.emit(Event{
+				Type:      EventFileProgress,
+				FileIndex: c.FilesToTransferCurrentNum,
+				File:      c.FilesToTransfer[c.FilesToTransferCurrentNum],
+				Bytes:     int64(n),
+			})
+			c.mutex.Lock()
+			c.TotalSent += int64(n)
+			c.mutex.Unlock()
+			pos += uint64(n)
+		}
+		if errRead == io.EOF || errRead == io.ErrUnexpectedEOF {
+			break
+		} else if errRead != nil {
+			c.dataError(&TransferError{Op: "read", File: c.currentFileName(), Err: errRead})
+			return
+		}
+	}
+	log.Debugf("stream ended after %d bytes", pos)
+	if err := c.sendChunk(0, c.FilesToTransferCurrentNum, streamEnd|pos, nil); err != nil {
+		if c.ctx.Err() == nil {
+			c.dataError(err)
+		}
+		return
+	}
+	sum := d.Sum()
+	digest = &sum
+	c.mutex.Lock()
+	c.streamSent = true
+	c.mutex.Unlock()
+}
+
+// hasSentStream reports whether all of the stream was sent
+func (c *Client) hasSentStream() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.streamSent
+}
+
+// addReceived counts the bytes and chunks received of the current file,
+// or of the current bundle, and reports whether all of its requested
+// data is received with them
+func (c *Client) addReceived(bytes int64, chunks int) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.TotalSent += bytes
+	c.TotalChunksTransfered += chunks
+	return c.receivedCurrentFile()
+}
+
+// endStream sets the length of the stream, or of the bundle, that ended
+// and reports whether all of it is received
+func (c *Client) endStream(size int64) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.streamSize = size
+	c.streamEnded = true
+	return c.receivedCurrentFile()
+}
+
+// receivedCurrentFile reports whether all the requested data of
+// the current file, or of the current bundle, is received. The
+// mutex is held by the caller.
+func (c *Client) receivedCurrentFile() bool {
+	if c.FilesToTransfer[c.FilesToTransferCurrentNum].IsStream || c.bundle != nil {
+		return c.streamEnded && c.TotalSent == c.streamSize
+	}
+	return c.TotalChunksTransfered == len(c.CurrentFileChunks) || c.TotalSent == c.FilesToTransfer[c.FilesToTransferCurrentNum].Size
+}
@@ -0,0 +1,76 @@
+package croc
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/schollz/croc/v8/src/utils"
+)
+
+// throttle limits the rate of the data sent or received
+// over all the data connections together
+type throttle struct {
+	mutex sync.Mutex
+	// rate is in bytes per second, 0 for no limit
+	rate int64
+	// next is when the data allowed so far is done
+	next time.Time
+}
+
+// setRate changes the rate, which applies to the data that is sent
+// or received from now on
+func (t *throttle) setRate(rate int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.rate = rate
+	t.next = time.Now()
+}
+
+// wait blocks until n more bytes are allowed
+func (t *throttle) wait(ctx context.Context, n int) error {
+	t.mutex.Lock()
+	if t.rate <= 0 {
+		t.mutex.Unlock()
+		return nil
+	}
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	delay := t.next.Sub(now)
+	t.next = t.next.Add(time.Duration(float64(n) / float64(t.rate) * float64(time.Second)))
+	t.mutex.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// parseThrottle returns the rate of a throttle such as "5M",
+// which is in bytes per second
+func parseThrottle(s string) (rate int64, err error) {
+	if s == "" {
+		return
+	}
+	return utils.ParseByteCountDecimal(s)
+}
+
+// SetThrottle changes the limit of the rate of the transfer, such as "5M"
+// for 5 MB per second, or "" for no limit. It can be called while files
+// are transferred.
+func (c *Client) SetThrottle(s string) (err error) {
+	rate, err := parseThrottle(s)
+	if err != nil {
+		return
+	}
+	c.throttle.setRate(rate)
+	return
+}
@@ -0,0 +1,221 @@
+package croc
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/schollz/logger"
+
+	"github.com/schollz/croc/v8/src/message"
+	"github.com/schollz/croc/v8/src/models"
+)
+
+// The recipient tunes the size of the chunks and the number of data
+// connections that send them from the throughput and round trip time it
+// measures, and requests them with each file from senders that can
+// tune. Chunk ranges of files that are partly received keep their own
+// chunk size, and the data connections are the ports of the relay, so
+// the streams are at most as many as those.
+const (
+	defaultChunkSize = models.TCP_BUFFER_SIZE / 2
+	minChunkSize     = 16 << 10
+	maxChunkSize     = 1 << 20
+	// tuneMinBytes is how much data a request needs to be measured
+	tuneMinBytes = 1 << 20
+	// tuneChunkTime is about how long a chunk should take on a stream
+	tuneChunkTime = 10 * time.Millisecond
+)
+
+// Messages are limited once decompressed to what they can be in the
+// step of the transfer, so that a peer can not make the other hold
+// much more than that in memory.
+const (
+	// controlMessageLimit is the most that a message can be
+	controlMessageLimit = 256 << 10
+	// fileMessageLimit is how much more a message can be for each file
+	// that it has the digest or the chunk ranges of
+	fileMessageLimit = 320 << 10
+	// maxMessageLimit is the most that the list of files can be,
+	// and that any message can be
+	maxMessageLimit = message.DefaultLimit
+)
+
+// tuner measures the data of the requests of the recipient
+// and chooses the chunk size and streams of the next one
+type tuner struct {
+	mutex      sync.Mutex
+	chunkSize  int
+	streams    int
+	maxStreams int
+	// step is the change of streams that is tried next
+	step int
+	// rtt is the smoothed time to the first data of a request
+	rtt time.Duration
+	// throughput of the last measured request, in bytes per second
+	throughput float64
+
+	requested time.Time
+	first     time.Time
+	bytes     int64
+}
+
+func newTuner(maxStreams int) *tuner {
+	return &tuner{
+		chunkSize:  defaultChunkSize,
+		streams:    maxStreams,
+		maxStreams: maxStreams,
+		step:       -1,
+	}
+}
+
+// start begins to measure a request
+func (t *tuner) start() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.requested = time.Now()
+	t.first = time.Time{}
+	t.bytes = 0
+}
+
+// add measures n bytes of data received
+func (t *tuner) add(n int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.first.IsZero() {
+		t.first = time.Now()
+		sample := t.first.Sub(t.requested)
+		if t.rtt == 0 {
+			t.rtt = sample
+		} else {
+			t.rtt = (7*t.rtt + sample) / 8
+		}
+	}
+	t.bytes += int64(n)
+}
+
+// finish ends the measurement of a request and tunes the next one
+func (t *tuner) finish() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	elapsed := time.Since(t.first)
+	if t.first.IsZero() || t.bytes < tuneMinBytes || elapsed <= 0 {
+		return
+	}
+	throughput := float64(t.bytes) / elapsed.Seconds()
+
+	// the streams climb towards the most throughput, and turn
+	// back once they make it noticeably worse
+	if t.throughput > 0 && throughput < 0.9*t.throughput {
+		t.step = -t.step
+	}
+	if t.throughput == 0 || throughput < 0.9*t.throughput || throughput > 1.1*t.throughput {
+		t.streams += t.step
+		if t.streams < 1 {
+			t.streams, t.step = 1, 1
+		} else if t.streams > t.maxStreams {
+			t.streams, t.step = t.maxStreams, -1
+		}
+	}
+	t.throughput = throughput
+
+	// chunks are larger as each stream is faster or the link is
+	// slower to respond, so that fewer of them are in flight
+	chunkTime := tuneChunkTime
+	if t.rtt/8 > chunkTime {
+		chunkTime = t.rtt / 8
+	}
+	target := int(throughput / float64(t.streams) * chunkTime.Seconds())
+	t.chunkSize = minChunkSize
+	for t.chunkSize*2 <= target && t.chunkSize < maxChunkSize {
+		t.chunkSize *= 2
+	}
+	log.Debugf("measured %.0f B/s with rtt %s, next chunks of %d over %d streams",
+		throughput, t.rtt, t.chunkSize, t.streams)
+}
+
+// request returns the chunk size and streams to request
+func (t *tuner) request() (chunkSize, streams int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.chunkSize, t.streams
+}
+
+// senderTune sets the chunk size and streams requested by the
+// recipient, which are the defaults if it does not tune
+func (c *Client) senderTune(remoteFile RemoteFileRequest) (err error) {
+	c.chunkSize = defaultChunkSize
+	c.streams = len(c.Options.RelayPorts)
+	if err = checkChunkRanges(remoteFile.CurrentFileChunkRanges); err != nil {
+		return
+	}
+	if remoteFile.ChunkSize != 0 {
+		if remoteFile.ChunkSize < minChunkSize || remoteFile.ChunkSize > maxChunkSize {
+			return fmt.Errorf("can not send chunks of %d bytes", remoteFile.ChunkSize)
+		}
+		c.chunkSize = remoteFile.ChunkSize
+	}
+	if remoteFile.Streams < 0 {
+		return fmt.Errorf("can not send over %d streams", remoteFile.Streams)
+	} else if remoteFile.Streams > 0 && remoteFile.Streams < c.streams {
+		// the recipient may have more ports than the sender uses
+		c.streams = remoteFile.Streams
+	}
+	return
+}
+
+// checkChunkRanges checks the chunk size of requested chunk ranges
+func checkChunkRanges(chunkRanges []int64) error {
+	if len(chunkRanges) > 0 && (chunkRanges[0] < minChunkSize || chunkRanges[0] > maxChunkSize) {
+		return fmt.Errorf("can not send chunks of %d bytes", chunkRanges[0])
+	}
+	return nil
+}
+
+// chunkLimit returns the most data that a chunk can have, once
+// decompressed, which is the chunk size that is requested
+func (c *Client) chunkLimit() int {
+	if c.chunkSize < defaultChunkSize {
+		// chunk ranges of partly received files
+		// are always of the default chunk size
+		return defaultChunkSize
+	}
+	return c.chunkSize
+}
+
+// messageLimit returns the most that the next message can be, once
+// decompressed, which is more than for control messages only for the
+// list of files and for the requests and digests of files
+func (c *Client) messageLimit() int {
+	var files int
+	switch {
+	case !c.Options.IsSender && c.Step1ChannelSecured && !c.Step2FileInfoTransfered:
+		return maxMessageLimit
+	case !c.Options.IsSender && c.Step3RecipientRequestFile:
+		// the digests of the files requested
+		files = len(c.pipeline) + len(c.bundle)
+	case c.Options.IsSender && c.Step2FileInfoTransfered && !c.Step3RecipientRequestFile:
+		// the chunk ranges of the files of a request
+		files = len(c.FilesToTransfer)
+		if files > pipelineMaxFiles {
+			files = pipelineMaxFiles
+		}
+	default:
+		return controlMessageLimit
+	}
+	if files < 1 {
+		files = 1
+	}
+	if files > (maxMessageLimit-controlMessageLimit)/fileMessageLimit {
+		return maxMessageLimit
+	}
+	return controlMessageLimit + files*fileMessageLimit
+}
+
+// chunkSizeOf returns the size of the chunks of a request of chunkRanges
+func (c *Client) chunkSizeOf(chunkRanges []int64) int {
+	if len(chunkRanges) > 0 {
+		return int(chunkRanges[0])
+	}
+	return c.chunkSize
+}
@@ -0,0 +1,99 @@
+package croc
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/schollz/mnemonicode"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/schollz/croc/v8/src/message"
+	"github.com/schollz/croc/v8/src/utils"
+)
+
+// Both peers derive a verification code from the key of the PAKE and the
+// handshake after it, which is the same for both unless a relay is in the
+// middle, and show it so that their users can compare them. With
+// Options.Verify a peer sends "verify" before its "externalip", and then
+// both users have to confirm that the codes match, each peer sending
+// "verified" once its user did, before the sender sends the files. A
+// peer waits for the other to send "verified" for verificationTimeout
+// at most once its own user confirmed.
+
+// verificationBytes is how much of the derived key makes up the code,
+// which is 3 words
+const verificationBytes = 4
+
+// verificationTimeout is how long the user of the peer has to confirm
+// the verification code
+var verificationTimeout = 2 * time.Minute
+
+// verificationCode returns the words of the verification code
+// derived from the key of the session and the transcript
+func verificationCode(sessionKey, transcript []byte) (code string, err error) {
+	b := make([]byte, verificationBytes)
+	r := hkdf.New(sha256.New, sessionKey, nil, append([]byte("croc verification "), transcript...))
+	if _, err = io.ReadFull(r, b); err != nil {
+		return
+	}
+	return strings.Join(mnemonicode.EncodeWordList(nil, b), "-"), nil
+}
+
+// handshakeTranscript returns the handshake after the PAKE, which is the
+// salt, the version of the key derivation and the ciphers
+func handshakeTranscript(salt []byte, version int, offered string, chosen string) []byte {
+	return []byte(fmt.Sprintf("%x %d %s %s", salt, version, offered, chosen))
+}
+
+// checkVerification checks that the peer can confirm the verification
+// codes with the version of the handshake, if the user wants them to
+func (c *Client) checkVerification(version int) error {
+	if c.Options.Verify && version < handshakeVerification {
+		return fmt.Errorf("peer can not confirm verification codes, it may need a newer version of croc")
+	}
+	return nil
+}
+
+// needsVerification reports whether the users have to confirm the codes
+func (c *Client) needsVerification() bool {
+	return c.Options.Verify || c.peerVerify
+}
+
+// verificationDone reports whether both users confirmed the codes,
+// or do not need to
+func (c *Client) verificationDone() bool {
+	return !c.needsVerification() || (c.verified && c.peerVerified)
+}
+
+// updateIfVerifying asks the user to confirm the verification code once
+// the channel is secured, and tells the peer
+func (c *Client) updateIfVerifying() (err error) {
+	if !c.Step1ChannelSecured || !c.needsVerification() || c.verified {
+		return
+	}
+	confirm := c.Options.ConfirmVerification
+	if confirm == nil {
+		confirm = promptVerification
+	}
+	if !confirm(c.verificationCode) {
+		err = fmt.Errorf("verification code does not match")
+		c.sendError(err)
+		return
+	}
+	c.verified = true
+	if !c.peerVerified {
+		c.verifyDeadline = time.After(verificationTimeout)
+	}
+	return message.Send(c.conn[0], c.Key, message.Message{Type: "verified"})
+}
+
+// promptVerification asks the user on the terminal whether the
+// verification code matches that of the peer
+func promptVerification(code string) bool {
+	fmt.Fprintf(os.Stderr, "\rDoes the verification code of the other side match '%s'? (y/n) ", code)
+	return strings.ToLower(strings.TrimSpace(utils.GetInput(""))) == "y"
+}
@@ -1,3 +1,18 @@
+// Package crypt encrypts with AEADs and derives their keys.
+//
+// Encrypt and Seal draw a random nonce for each message. With the nonces
+// of 12 bytes of AES-GCM and ChaCha20-Poly1305, a key should encrypt at
+// most 2^32 messages that way before a repeated nonce, which breaks the
+// encryption, becomes too likely (NIST SP 800-38D, section 8.3). With
+// 32 KiB messages that is 128 TiB, and much less for a safe margin.
+// XChaCha20-Poly1305 has nonces of 24 bytes, which do not repeat by
+// chance.
+//
+// A Stream uses counters as nonces, so they never repeat under a key.
+// AES-GCM still loses its margin against forgeries as a key encrypts
+// more blocks, so a Stream replaces its key after the Limits, by default
+// 2^24 messages or 64 GiB, and at most after MaxStreamMessages messages
+// or MaxStreamBytes bytes.
 package crypt
 
 import (
@@ -6,12 +21,64 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"fmt"
+	"io"
 	"log"
 
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
 	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/sys/cpu"
 )
 
-// New generates a new key based on a passphrase and salt
+// Cipher is an AEAD that encrypts with a key of 32 bytes
+type Cipher string
+
+const (
+	AESGCM            Cipher = "aes-gcm"
+	ChaCha20Poly1305  Cipher = "chacha20-poly1305"
+	XChaCha20Poly1305 Cipher = "xchacha20-poly1305"
+)
+
+// Ciphers are those supported
+var Ciphers = []Cipher{AESGCM, ChaCha20Poly1305, XChaCha20Poly1305}
+
+// HasAESHardware reports whether the CPU has instructions that make
+// AES-GCM fast, without which ChaCha20-Poly1305 is faster
+func HasAESHardware() bool {
+	return (cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ) ||
+		(cpu.ARM64.HasAES && cpu.ARM64.HasPMULL) ||
+		(cpu.S390X.HasAES && cpu.S390X.HasAESGCM)
+}
+
+// Preferred returns the cipher that is fastest on this CPU
+func Preferred() Cipher {
+	if HasAESHardware() {
+		return AESGCM
+	}
+	return ChaCha20Poly1305
+}
+
+// NewAEAD returns the AEAD of the cipher with the key
+func NewAEAD(c Cipher, key []byte) (aead cipher.AEAD, err error) {
+	switch c {
+	case AESGCM:
+		var b cipher.Block
+		b, err = aes.NewCipher(key)
+		if err != nil {
+			return
+		}
+		return cipher.NewGCM(b)
+	case ChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	case XChaCha20Poly1305:
+		return chacha20poly1305.NewX(key)
+	}
+	return nil, fmt.Errorf("unknown cipher '%s'", c)
+}
+
+// New generates a new key based on a passphrase and salt. It is kept for
+// peers that derive keys this way, use NewArgon2id for new passphrases.
 func New(passphrase []byte, usersalt []byte) (key []byte, salt []byte, err error) {
 	if len(passphrase) < 1 {
 		err = fmt.Errorf("need more than that for passphrase")
@@ -31,42 +98,116 @@ func New(passphrase []byte, usersalt []byte) (key []byte, salt []byte, err error
 	return
 }
 
+// Argon2idSaltSize is the size of the salts of NewArgon2id
+const Argon2idSaltSize = 16
+
+// NewArgon2id generates a new key based on a passphrase and salt with
+// Argon2id, which makes guessing the passphrase costly. It takes 2
+// passes over 19 MiB, the least that OWASP recommends, as a relay
+// derives a key for each connection.
+func NewArgon2id(passphrase []byte, usersalt []byte) (key []byte, salt []byte, err error) {
+	if len(passphrase) < 1 {
+		err = fmt.Errorf("need more than that for passphrase")
+		return
+	}
+	if usersalt == nil {
+		salt = make([]byte, Argon2idSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			log.Fatalf("can't get random salt: %v", err)
+		}
+	} else {
+		salt = usersalt
+	}
+	key = argon2.IDKey(passphrase, salt, 2, 19*1024, 1, 32)
+	return
+}
+
+// SessionKeys are the keys of a session, each for its own use
+type SessionKeys struct {
+	// Control is the key of the messages between the peers
+	Control []byte
+	// SenderData and RecipientData are the keys of the data
+	// sent by the sender and by the recipient
+	SenderData    []byte
+	RecipientData []byte
+}
+
+// NewSessionKeys derives the keys of a session with HKDF from its key,
+// which has to be of high entropy already, such as that of a PAKE. The
+// info binds the keys to the context they are derived in.
+func NewSessionKeys(sessionKey []byte, salt []byte, info []byte) (keys SessionKeys, err error) {
+	if len(sessionKey) < 16 {
+		err = fmt.Errorf("session key is too short")
+		return
+	}
+	derive := func(label string) (key []byte, err error) {
+		key = make([]byte, 32)
+		r := hkdf.New(sha256.New, sessionKey, salt, append([]byte(label), info...))
+		_, err = io.ReadFull(r, key)
+		return
+	}
+	if keys.Control, err = derive("croc control "); err != nil {
+		return
+	}
+	if keys.SenderData, err = derive("croc sender data "); err != nil {
+		return
+	}
+	keys.RecipientData, err = derive("croc recipient data ")
+	return
+}
+
 // Encrypt will encrypt using the pre-generated key
 func Encrypt(plaintext []byte, key []byte) (encrypted []byte, err error) {
+	return EncryptWith(plaintext, key, nil)
+}
+
+// EncryptWith will encrypt using the pre-generated key and authenticate
+// the associated data with it, which is not encrypted nor included
+func EncryptWith(plaintext []byte, key []byte, associatedData []byte) (encrypted []byte, err error) {
+	aead, err := NewAEAD(AESGCM, key)
+	if err != nil {
+		return
+	}
+	return Seal(aead, plaintext, associatedData)
+}
+
+// Seal encrypts with the AEAD and authenticates the associated data,
+// with a random nonce that is before the encrypted data
+func Seal(aead cipher.AEAD, plaintext []byte, associatedData []byte) (encrypted []byte, err error) {
 	// generate a random iv each time
 	// http://nvlpubs.nist.gov/nistpubs/Legacy/SP/nistspecialpublication800-38d.pdf
 	// Section 8.2
-	ivBytes := make([]byte, 12)
+	ivBytes := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
 	if _, err := rand.Read(ivBytes); err != nil {
 		log.Fatalf("can't initialize crypto: %v", err)
 	}
-	b, err := aes.NewCipher(key)
-	if err != nil {
-		return
-	}
-	aesgcm, err := cipher.NewGCM(b)
-	if err != nil {
-		return
-	}
-	encrypted = aesgcm.Seal(nil, ivBytes, plaintext, nil)
-	encrypted = append(ivBytes, encrypted...)
+	encrypted = aead.Seal(ivBytes, ivBytes, plaintext, associatedData)
 	return
 }
 
 // Decrypt using the pre-generated key
 func Decrypt(encrypted []byte, key []byte) (plaintext []byte, err error) {
-	if len(encrypted) < 13 {
-		err = fmt.Errorf("incorrect passphrase")
-		return
-	}
-	b, err := aes.NewCipher(key)
+	return DecryptWith(encrypted, key, nil)
+}
+
+// DecryptWith using the pre-generated key, which fails unless the
+// associated data is the same as that it was encrypted with
+func DecryptWith(encrypted []byte, key []byte, associatedData []byte) (plaintext []byte, err error) {
+	aead, err := NewAEAD(AESGCM, key)
 	if err != nil {
 		return
 	}
-	aesgcm, err := cipher.NewGCM(b)
-	if err != nil {
+	return Open(aead, encrypted, associatedData)
+}
+
+// Open decrypts what Seal encrypted with the AEAD, which fails unless
+// the associated data is the same
+func Open(aead cipher.AEAD, encrypted []byte, associatedData []byte) (plaintext []byte, err error) {
+	if len(encrypted) < aead.NonceSize()+1 {
+		err = fmt.Errorf("incorrect passphrase")
 		return
 	}
-	plaintext, err = aesgcm.Open(nil, encrypted[:12], encrypted[12:], nil)
+	n := aead.NonceSize()
+	plaintext, err = aead.Open(nil, encrypted[:n], encrypted[n:], associatedData)
 	return
 }
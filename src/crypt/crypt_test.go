@@ -53,3 +53,214 @@ func TestEncryption(t *testing.T) {
 	_, _, err = New([]byte(""), nil)
 	assert.NotNil(t, err)
 }
+
+func TestEncryptionWith(t *testing.T) {
+	key, _, err := New([]byte("password"), nil)
+	assert.Nil(t, err)
+	msg := []byte("hello, world")
+	enc, err := EncryptWith(msg, key, []byte("file 1"))
+	assert.Nil(t, err)
+	dec, err := DecryptWith(enc, key, []byte("file 1"))
+	assert.Nil(t, err)
+	assert.Equal(t, msg, dec)
+
+	// the associated data has to be the same
+	_, err = DecryptWith(enc, key, []byte("file 2"))
+	assert.NotNil(t, err)
+	_, err = Decrypt(enc, key)
+	assert.NotNil(t, err)
+
+	// no associated data is the same as with Encrypt
+	enc, err = Encrypt(msg, key)
+	assert.Nil(t, err)
+	dec, err = DecryptWith(enc, key, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, msg, dec)
+}
+
+func TestNewArgon2id(t *testing.T) {
+	key, salt, err := NewArgon2id([]byte("password"), nil)
+	assert.Nil(t, err)
+	assert.Len(t, key, 32)
+	assert.Len(t, salt, 16)
+	key2, _, err := NewArgon2id([]byte("password"), salt)
+	assert.Nil(t, err)
+	assert.Equal(t, key, key2)
+	key2, _, err = NewArgon2id([]byte("wrong password"), salt)
+	assert.Nil(t, err)
+	assert.NotEqual(t, key, key2)
+	_, _, err = NewArgon2id([]byte(""), nil)
+	assert.NotNil(t, err)
+}
+
+func TestNewSessionKeys(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	for i := range sessionKey {
+		sessionKey[i] = byte(i)
+	}
+	keys, err := NewSessionKeys(sessionKey, []byte("salt"), []byte("v1"))
+	assert.Nil(t, err)
+	assert.Len(t, keys.Control, 32)
+	assert.NotEqual(t, keys.Control, keys.SenderData)
+	assert.NotEqual(t, keys.Control, keys.RecipientData)
+	assert.NotEqual(t, keys.SenderData, keys.RecipientData)
+
+	// the keys are the same for the same session
+	keys2, err := NewSessionKeys(sessionKey, []byte("salt"), []byte("v1"))
+	assert.Nil(t, err)
+	assert.Equal(t, keys, keys2)
+	// and differ for another salt or info
+	keys2, err = NewSessionKeys(sessionKey, []byte("salt2"), []byte("v1"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, keys.Control, keys2.Control)
+	keys2, err = NewSessionKeys(sessionKey, []byte("salt"), []byte("v2"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, keys.Control, keys2.Control)
+
+	_, err = NewSessionKeys([]byte("short"), nil, nil)
+	assert.NotNil(t, err)
+}
+
+func TestCiphers(t *testing.T) {
+	key, _, err := New([]byte("password"), nil)
+	assert.Nil(t, err)
+	msg := []byte("hello, world")
+	for _, c := range Ciphers {
+		aead, err := NewAEAD(c, key)
+		assert.Nil(t, err)
+		enc, err := Seal(aead, msg, []byte("file 1"))
+		assert.Nil(t, err)
+		assert.Len(t, enc, aead.NonceSize()+len(msg)+aead.Overhead())
+		dec, err := Open(aead, enc, []byte("file 1"))
+		assert.Nil(t, err)
+		assert.Equal(t, msg, dec)
+		_, err = Open(aead, enc, []byte("file 2"))
+		assert.NotNil(t, err)
+		_, err = Open(aead, enc[:aead.NonceSize()], nil)
+		assert.NotNil(t, err)
+
+		// each cipher is its own
+		other, err := NewAEAD(AESGCM, key)
+		assert.Nil(t, err)
+		if c != AESGCM {
+			_, err = Open(other, enc, []byte("file 1"))
+			assert.NotNil(t, err)
+		}
+	}
+	aead, err := NewAEAD(XChaCha20Poly1305, key)
+	assert.Nil(t, err)
+	assert.Equal(t, 24, aead.NonceSize())
+
+	// AES-GCM is the cipher of Encrypt
+	aead, err = NewAEAD(AESGCM, key)
+	assert.Nil(t, err)
+	enc, err := Encrypt(msg, key)
+	assert.Nil(t, err)
+	dec, err := Open(aead, enc, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, msg, dec)
+
+	_, err = NewAEAD("rot13", key)
+	assert.NotNil(t, err)
+	_, err = NewAEAD(ChaCha20Poly1305, key[:16])
+	assert.NotNil(t, err)
+	assert.Contains(t, Ciphers, Preferred())
+}
+
+func TestStream(t *testing.T) {
+	key, _, err := New([]byte("password"), nil)
+	assert.Nil(t, err)
+	for _, c := range Ciphers {
+		limits := Limits{Messages: 3, Bytes: 100}
+		sender, err := NewStream(c, key, 1, limits)
+		assert.Nil(t, err)
+		recipient, err := NewStream(c, key, 1, Limits{})
+		assert.Nil(t, err)
+
+		// the nonces are unique across keys, as the generation of
+		// the key is in them
+		nonces := make(map[string]struct{})
+		var sealed [][]byte
+		for i := 0; i < 9; i++ {
+			enc, err := sender.Seal([]byte("hello, world"), []byte("chunk"))
+			assert.Nil(t, err)
+			nonce := string(enc[:sender.aead.NonceSize()])
+			_, repeated := nonces[nonce]
+			assert.False(t, repeated)
+			nonces[nonce] = struct{}{}
+			sealed = append(sealed, enc)
+		}
+		// the key is replaced every 3 messages
+		assert.Equal(t, uint32(2), sender.Generation())
+
+		// messages can not be opened out of order, nor twice
+		_, err = recipient.Open(sealed[1], []byte("chunk"))
+		assert.NotNil(t, err)
+		for i, enc := range sealed {
+			dec, err := recipient.Open(enc, []byte("chunk"))
+			assert.Nil(t, err, i)
+			assert.Equal(t, []byte("hello, world"), dec)
+		}
+		assert.Equal(t, uint32(2), recipient.Generation())
+		_, err = recipient.Open(sealed[8], []byte("chunk"))
+		assert.NotNil(t, err)
+
+		// a forged message of the next key does not replace it
+		enc, err := sender.Seal([]byte("hello, world"), []byte("chunk"))
+		assert.Nil(t, err)
+		_, err = recipient.Open(enc, []byte("other chunk"))
+		assert.NotNil(t, err)
+		assert.Equal(t, uint32(2), recipient.Generation())
+		_, err = recipient.Open(enc, []byte("chunk"))
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(3), recipient.Generation())
+	}
+}
+
+func TestStreamLimits(t *testing.T) {
+	key, _, err := New([]byte("password"), nil)
+	assert.Nil(t, err)
+	sender, err := NewStream(AESGCM, key, 0, Limits{Bytes: 100})
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultLimits.Messages, sender.limits.Messages)
+	recipient, err := NewStream(AESGCM, key, 0, Limits{})
+	assert.Nil(t, err)
+
+	// the key is replaced before a message that takes it past its bytes
+	for _, size := range []int{60, 40, 1, 99, 2, 150, 10} {
+		enc, err := sender.Seal(make([]byte, size), nil)
+		assert.Nil(t, err)
+		_, err = recipient.Open(enc, nil)
+		assert.Nil(t, err)
+	}
+	// 60+40, 1+99, 2, 150, 10
+	assert.Equal(t, uint32(4), sender.Generation())
+	assert.Equal(t, uint32(4), recipient.Generation())
+
+	// the limits are at most the maximum
+	s, err := NewStream(AESGCM, key, 0, Limits{Messages: 1 << 40, Bytes: 1 << 40})
+	assert.Nil(t, err)
+	assert.Equal(t, Limits{Messages: MaxStreamMessages, Bytes: MaxStreamBytes}, s.limits)
+	// which the recipient enforces
+	recipient.counter = MaxStreamMessages
+	sender.counter = MaxStreamMessages
+	sender.limits.Messages = MaxStreamMessages + 1
+	enc, err := sender.Seal([]byte("hello"), nil)
+	assert.Nil(t, err)
+	_, err = recipient.Open(enc, nil)
+	assert.NotNil(t, err)
+
+	// streams of other ids or keys do not open the messages
+	sender, err = NewStream(AESGCM, key, 0, Limits{})
+	assert.Nil(t, err)
+	enc, err = sender.Seal([]byte("hello"), nil)
+	assert.Nil(t, err)
+	other, err := NewStream(AESGCM, key, 1, Limits{})
+	assert.Nil(t, err)
+	_, err = other.Open(enc, nil)
+	assert.NotNil(t, err)
+	_, err = other.Open(enc[:10], nil)
+	assert.NotNil(t, err)
+	_, err = NewStream("rot13", key, 0, Limits{})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,155 @@
+package crypt
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// MaxStreamMessages and MaxStreamBytes are the most messages and
+	// bytes that a key of a Stream encrypts, whatever its Limits
+	MaxStreamMessages = 1 << 32
+	MaxStreamBytes    = 1 << 38
+)
+
+// Limits are of the messages and bytes that a key of a Stream encrypts,
+// after which it is replaced by the next one
+type Limits struct {
+	Messages uint64
+	Bytes    uint64
+}
+
+// DefaultLimits are used for the Limits that are 0
+var DefaultLimits = Limits{Messages: 1 << 24, Bytes: 1 << 36}
+
+// Stream encrypts messages in order with a counter as nonce, and with
+// a new key after the messages or bytes of its Limits. The nonce is
+// before the encrypted data, and is the generation of the key and the
+// counter of the message. The messages are opened in the order they
+// are sealed, by a Stream with the same key and id, which replaces its
+// key when the nonce is of the next one. A Stream is not safe for
+// concurrent use.
+type Stream struct {
+	cipher Cipher
+	key    []byte
+	aead   cipher.AEAD
+	limits Limits
+
+	generation uint32
+	counter    uint64
+	bytes      uint64
+}
+
+// NewStream returns a Stream of the cipher, whose first key is derived
+// from the key and the id, so that streams of different ids under the
+// same key do not share nonces
+func NewStream(c Cipher, key []byte, id uint32, limits Limits) (s *Stream, err error) {
+	if limits.Messages == 0 {
+		limits.Messages = DefaultLimits.Messages
+	}
+	if limits.Bytes == 0 {
+		limits.Bytes = DefaultLimits.Bytes
+	}
+	if limits.Messages > MaxStreamMessages {
+		limits.Messages = MaxStreamMessages
+	}
+	if limits.Bytes > MaxStreamBytes {
+		limits.Bytes = MaxStreamBytes
+	}
+	s = &Stream{cipher: c, limits: limits}
+	s.key, err = deriveStreamKey(key, fmt.Sprintf("croc stream %d", id))
+	if err != nil {
+		return
+	}
+	s.aead, err = NewAEAD(c, s.key)
+	return
+}
+
+// deriveStreamKey derives a key of a stream with HKDF
+func deriveStreamKey(key []byte, label string) (derived []byte, err error) {
+	derived = make([]byte, 32)
+	_, err = io.ReadFull(hkdf.New(sha256.New, key, nil, []byte(label)), derived)
+	return
+}
+
+// next returns the next key and its AEAD
+func (s *Stream) next() (key []byte, aead cipher.AEAD, err error) {
+	key, err = deriveStreamKey(s.key, "croc rekey")
+	if err != nil {
+		return
+	}
+	aead, err = NewAEAD(s.cipher, key)
+	return
+}
+
+// rekey replaces the key by the next one
+func (s *Stream) rekey(key []byte, aead cipher.AEAD) {
+	s.key, s.aead = key, aead
+	s.generation++
+	s.counter = 0
+	s.bytes = 0
+}
+
+// Generation returns how many times the key was replaced
+func (s *Stream) Generation() uint32 {
+	return s.generation
+}
+
+// Seal encrypts the next message and authenticates the associated data
+func (s *Stream) Seal(plaintext []byte, associatedData []byte) (encrypted []byte, err error) {
+	if s.counter >= s.limits.Messages ||
+		(s.counter > 0 && s.bytes+uint64(len(plaintext)) > s.limits.Bytes) {
+		key, aead, err := s.next()
+		if err != nil {
+			return nil, err
+		}
+		s.rekey(key, aead)
+	}
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(plaintext)+s.aead.Overhead())
+	binary.BigEndian.PutUint32(nonce, s.generation)
+	binary.BigEndian.PutUint64(nonce[4:], s.counter)
+	encrypted = s.aead.Seal(nonce, nonce, plaintext, associatedData)
+	s.counter++
+	s.bytes += uint64(len(plaintext))
+	return
+}
+
+// Open decrypts the next message, which fails unless it is the next
+// that was sealed and the associated data is the same
+func (s *Stream) Open(encrypted []byte, associatedData []byte) (plaintext []byte, err error) {
+	n := s.aead.NonceSize()
+	if len(encrypted) < n+s.aead.Overhead() {
+		return nil, fmt.Errorf("message too short")
+	}
+	generation := binary.BigEndian.Uint32(encrypted)
+	counter := binary.BigEndian.Uint64(encrypted[4:])
+	aead := s.aead
+	var key []byte
+	switch {
+	case generation == s.generation && counter == s.counter:
+		if counter >= MaxStreamMessages || s.bytes+uint64(len(encrypted)-n-aead.Overhead()) > MaxStreamBytes {
+			return nil, fmt.Errorf("message past the limits of its key")
+		}
+	case generation == s.generation+1 && counter == 0 && s.counter > 0:
+		if key, aead, err = s.next(); err != nil {
+			return
+		}
+	default:
+		return nil, fmt.Errorf("message %d of key %d is out of order", counter, generation)
+	}
+	plaintext, err = aead.Open(nil, encrypted[:n], encrypted[n:], associatedData)
+	if err != nil {
+		return
+	}
+	if key != nil {
+		s.rekey(key, aead)
+	}
+	s.counter++
+	s.bytes += uint64(len(plaintext))
+	return
+}
@@ -2,6 +2,7 @@ package message
 
 import (
 	"encoding/json"
+	"fmt"
 
 	"github.com/schollz/croc/v8/src/comm"
 	"github.com/schollz/croc/v8/src/compress"
@@ -48,15 +49,31 @@ func Encode(key []byte, m Message) (b []byte, err error) {
 	return
 }
 
+// DefaultLimit is the most that a message decoded by Decode can be
+const DefaultLimit = 32 << 20
+
 // Decode will convert from bytes
 func Decode(key []byte, b []byte) (m Message, err error) {
+	return DecodeLimit(key, b, DefaultLimit)
+}
+
+// DecodeLimit will convert from bytes a message
+// that is at most limit bytes once decompressed
+func DecodeLimit(key []byte, b []byte, limit int) (m Message, err error) {
 	if key != nil {
 		b, err = crypt.Decrypt(b, key)
 		if err != nil {
 			return
 		}
 	}
-	b = compress.Decompress(b)
+	// an empty message, which is sent while the room is not ready,
+	// fails to be unmarshaled rather than to be decompressed
+	if len(b) > 0 {
+		b, err = compress.DecompressLimit(b, limit)
+		if err != nil {
+			return m, fmt.Errorf("could not decompress message: %w", err)
+		}
+	}
 	err = json.Unmarshal(b, &m)
 	return
 }
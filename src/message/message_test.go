@@ -2,12 +2,14 @@ package message
 
 import (
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"net"
 	"testing"
 	"time"
 
 	"github.com/schollz/croc/v8/src/comm"
+	"github.com/schollz/croc/v8/src/compress"
 	"github.com/schollz/croc/v8/src/crypt"
 	log "github.com/schollz/logger"
 	"github.com/stretchr/testify/assert"
@@ -33,6 +35,23 @@ func TestMessage(t *testing.T) {
 	assert.NotNil(t, err)
 }
 
+func TestDecodeLimit(t *testing.T) {
+	m := Message{Type: "message", Bytes: make([]byte, 1<<20)}
+	b, err := Encode(nil, m)
+	assert.Nil(t, err)
+	assert.True(t, len(b) < 1<<20)
+	_, err = DecodeLimit(nil, b, 1<<20)
+	assert.True(t, errors.Is(err, compress.ErrTooLarge))
+	m2, err := DecodeLimit(nil, b, 2<<20)
+	assert.Nil(t, err)
+	assert.Equal(t, m, m2)
+
+	// an empty message is not decompressed
+	_, err = DecodeLimit(nil, []byte{}, 1<<20)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "unexpected end of JSON input")
+}
+
 func TestMessageNoPass(t *testing.T) {
 	log.SetLevel("debug")
 	m := Message{Type: "message", Message: "hello, world"}
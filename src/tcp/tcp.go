@@ -2,6 +2,8 @@ package tcp
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
@@ -17,11 +19,14 @@ import (
 )
 
 type server struct {
+	ctx        context.Context
 	port       string
 	debugLevel string
 	banner     string
 	password   string
 	rooms      roomMap
+	// version is the highest version of the key that it derives
+	version int
 }
 
 type roomInfo struct {
@@ -41,10 +46,17 @@ var pingRoom = "pinglkasjdlfjsaldjf"
 
 // Run starts a tcp listener, run async
 func Run(debugLevel, port, password string, banner ...string) (err error) {
+	return RunContext(context.Background(), debugLevel, port, password, banner...)
+}
+
+// RunContext starts a tcp listener that stops once ctx is done, run async
+func RunContext(ctx context.Context, debugLevel, port, password string, banner ...string) (err error) {
 	s := new(server)
+	s.ctx = ctx
 	s.port = port
 	s.password = password
 	s.debugLevel = debugLevel
+	s.version = relayVersion
 	if len(banner) > 0 {
 		s.banner = banner[0]
 	}
@@ -61,7 +73,11 @@ func (s *server) start() (err error) {
 	// delete old rooms
 	go func() {
 		for {
-			time.Sleep(timeToRoomDeletion)
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-time.After(timeToRoomDeletion):
+			}
 			var roomsToDelete []string
 			s.rooms.Lock()
 			for room := range s.rooms.rooms {
@@ -91,10 +107,18 @@ func (s *server) run() (err error) {
 		return fmt.Errorf("error listening on %s: %w", s.port, err)
 	}
 	defer server.Close()
+	go func() {
+		<-s.ctx.Done()
+		server.Close()
+	}()
 	// spawn a new goroutine whenever a client connects
 	for {
 		connection, err := server.Accept()
 		if err != nil {
+			if s.ctx.Err() != nil {
+				log.Debugf("stopping TCP server on %s", s.port)
+				return nil
+			}
 			return fmt.Errorf("problem accepting connection: %w", err)
 		}
 		log.Debugf("client %s connected", connection.RemoteAddr().String())
@@ -150,6 +174,33 @@ func (s *server) run() (err error) {
 
 var weakKey = []byte{1, 2, 3}
 
+// After the PAKE the client sends the salt of the key that encrypts the
+// rest of the connection to the relay, and its size is of the version of
+// the key. With version 0 the key is derived with PBKDF2 and a salt of 8
+// bytes, from version 1 with Argon2id and a salt of 16 bytes. A relay
+// before version 1 derives a different key, can not decrypt the password
+// and closes the connection, so the client connects again with version 0.
+const (
+	relayLegacy   = 0
+	relayArgon2id = 1
+	// relayVersion is the highest version supported
+	relayVersion = relayArgon2id
+)
+
+// errRelayVersion is returned when the relay does not support the version
+var errRelayVersion = errors.New("relay does not support the version")
+
+// relayKey derives the key of a connection to the relay from the key of
+// the PAKE and the salt, with the version of its size up to the version
+func relayKey(strongKey, salt []byte, version int) (key []byte, err error) {
+	if version >= relayArgon2id && len(salt) == crypt.Argon2idSaltSize {
+		key, _, err = crypt.NewArgon2id(strongKey, salt)
+		return
+	}
+	key, _, err = crypt.New(strongKey, salt)
+	return
+}
+
 func (s *server) clientCommunication(port string, c *comm.Comm) (room string, err error) {
 	// establish secure password with PAKE for communication with relay
 	B, err := pake.InitCurve(weakKey, 1, "siec", 1*time.Microsecond)
@@ -186,7 +237,10 @@ func (s *server) clientCommunication(port string, c *comm.Comm) (room string, er
 
 	// receive salt
 	salt, err := c.Receive()
-	strongKeyForEncryption, _, err := crypt.New(strongKey, salt)
+	if err != nil {
+		return
+	}
+	strongKeyForEncryption, err := relayKey(strongKey, salt, s.version)
 	if err != nil {
 		return
 	}
@@ -409,6 +463,16 @@ func PingServer(address string) (err error) {
 // ConnectToTCPServer will initiate a new connection
 // to the specified address, room with optional time limit
 func ConnectToTCPServer(address, password, room string, timelimit ...time.Duration) (c *comm.Comm, banner string, ipaddr string, err error) {
+	c, banner, ipaddr, err = connectToTCPServer(relayVersion, address, password, room, timelimit...)
+	if errors.Is(err, errRelayVersion) {
+		log.Debugf("connecting again with version %d: %v", relayLegacy, err)
+		c, banner, ipaddr, err = connectToTCPServer(relayLegacy, address, password, room, timelimit...)
+	}
+	return
+}
+
+// connectToTCPServer connects with the version of the key
+func connectToTCPServer(version int, address, password, room string, timelimit ...time.Duration) (c *comm.Comm, banner string, ipaddr string, err error) {
 	if len(timelimit) > 0 {
 		c, err = comm.NewConnection(address, timelimit[0])
 	} else {
@@ -445,7 +509,15 @@ func ConnectToTCPServer(address, password, room string, timelimit ...time.Durati
 	}
 	log.Debugf("strong key: %x", strongKey)
 
-	strongKeyForEncryption, salt, err := crypt.New(strongKey, nil)
+	var strongKeyForEncryption, salt []byte
+	if version >= relayArgon2id {
+		strongKeyForEncryption, salt, err = crypt.NewArgon2id(strongKey, nil)
+	} else {
+		strongKeyForEncryption, salt, err = crypt.New(strongKey, nil)
+	}
+	if err != nil {
+		return
+	}
 	// send salt
 	err = c.Send(salt)
 	if err != nil {
@@ -464,6 +536,11 @@ func ConnectToTCPServer(address, password, room string, timelimit ...time.Durati
 	log.Debug("waiting for first ok")
 	enc, err := c.Receive()
 	if err != nil {
+		if version > relayLegacy {
+			// the relay may not support the version
+			c.Close()
+			err = fmt.Errorf("%w %d: %v", errRelayVersion, version, err)
+		}
 		return
 	}
 	data, err := crypt.Decrypt(enc, strongKeyForEncryption)
@@ -2,6 +2,8 @@ package tcp
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -69,3 +71,31 @@ func TestTCP(t *testing.T) {
 	c1.Close()
 	time.Sleep(300 * time.Millisecond)
 }
+
+func TestTCPVersions(t *testing.T) {
+	log.SetLevel("error")
+	go Run("debug", "8285", "pass123", "8286")
+	// a relay before the versions
+	legacy := &server{
+		ctx:        context.Background(),
+		port:       "8287",
+		debugLevel: "debug",
+		password:   "pass123",
+		banner:     "8288",
+		version:    relayLegacy,
+	}
+	go legacy.start()
+	time.Sleep(100 * time.Millisecond)
+
+	c, banner, _, err := connectToTCPServer(relayLegacy, "localhost:8285", "pass123", "legacyClient", 1*time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, "8286", banner)
+	c.Close()
+
+	_, _, _, err = connectToTCPServer(relayArgon2id, "localhost:8287", "pass123", "legacyRelay", 1*time.Minute)
+	assert.True(t, errors.Is(err, errRelayVersion))
+	c, banner, _, err = ConnectToTCPServer("localhost:8287", "pass123", "legacyRelay", 1*time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, "8288", banner)
+	c.Close()
+}
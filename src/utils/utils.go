@@ -6,6 +6,7 @@ import (
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -15,12 +16,14 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/cespare/xxhash"
 	"github.com/kalafut/imohash"
 	"github.com/schollz/mnemonicode"
+	"github.com/spaolacci/murmur3"
 )
 
 // Exists reports whether the named file or directory exists.
@@ -70,6 +73,40 @@ func IMOHashFile(fname string) (hash []byte, err error) {
 	return
 }
 
+// IMOHashReader returns the imohash of the size bytes read from r,
+// which is the same as IMOHashFile of a file with that content.
+// The samples are read with ReadAt if r is an io.ReaderAt.
+func IMOHashReader(r io.Reader, size int64) (hash []byte, err error) {
+	if ra, ok := r.(io.ReaderAt); ok {
+		r = io.NewSectionReader(ra, 0, size)
+	}
+	h := murmur3.New128()
+	if size < imohash.SampleThreshold {
+		if _, err = io.CopyN(h, r, size); err != nil {
+			return
+		}
+	} else {
+		var pos int64
+		for _, offset := range []int64{0, size / 2, size - imohash.SampleSize} {
+			if s, ok := r.(io.Seeker); ok {
+				_, err = s.Seek(offset, io.SeekStart)
+			} else {
+				_, err = io.CopyN(ioutil.Discard, r, offset-pos)
+			}
+			if err != nil {
+				return
+			}
+			if _, err = io.CopyN(h, r, imohash.SampleSize); err != nil {
+				return
+			}
+			pos = offset + imohash.SampleSize
+		}
+	}
+	hash = h.Sum(nil)
+	binary.PutUvarint(hash, uint64(size))
+	return
+}
+
 // XXHashFile returns the xxhash of a file
 func XXHashFile(fname string) (hash256 []byte, err error) {
 	f, err := os.Open(fname)
@@ -148,6 +185,28 @@ func ByteCountDecimal(b int64) string {
 	return fmt.Sprintf("%.1f %cB", float64(b)/float64(div), "kMGTPE"[exp])
 }
 
+// ParseByteCountDecimal converts a byte string such as "5M", "1.5 MB"
+// or "500k" to bytes, the reverse of ByteCountDecimal
+func ParseByteCountDecimal(s string) (b int64, err error) {
+	s = strings.TrimSpace(s)
+	num := strings.TrimRight(s, "kKmMgGtTpPeEbB ")
+	unit := strings.ToUpper(strings.TrimSpace(s[len(num):]))
+	unit = strings.TrimSuffix(unit, "B")
+	multiplier := float64(1)
+	if unit != "" {
+		exp := strings.Index("KMGTPE", unit)
+		if len(unit) != 1 || exp < 0 {
+			return 0, fmt.Errorf("unknown unit in '%s'", s)
+		}
+		multiplier = math.Pow(1000, float64(exp+1))
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("could not parse '%s'", s)
+	}
+	return int64(f * multiplier), nil
+}
+
 // MissingChunks returns the positions of missing chunks.
 // If file doesn't exist, it returns an empty chunk list (all chunks).
 // If the file size is not the same as requested, it returns an empty chunk list (all chunks).
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io/ioutil"
@@ -73,6 +74,29 @@ func TestIMOHashFile(t *testing.T) {
 	assert.Equal(t, "c0d1e123ca94148ffea146137684ebb9", fmt.Sprintf("%x", b))
 }
 
+func TestIMOHashReader(t *testing.T) {
+	for _, size := range []int{0, 100, 128 * 1024, 1000000} {
+		data := make([]byte, size)
+		rand.Read(data)
+		ioutil.WriteFile("imohash.test", data, 0666)
+		expected, err := IMOHashFile("imohash.test")
+		assert.Nil(t, err)
+		os.Remove("imohash.test")
+
+		b, err := IMOHashReader(bytes.NewReader(data), int64(size))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, b)
+		// anything after size is not hashed
+		b, err = IMOHashReader(strings.NewReader(string(data)+"trailing"), int64(size))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, b)
+		// readers that can not seek are read through
+		b, err = IMOHashReader(bufio.NewReader(bytes.NewReader(data)), int64(size))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, b)
+	}
+}
+
 func TestXXHashFile(t *testing.T) {
 	bigFile()
 	defer os.Remove("bigfile.test")
@@ -93,6 +117,25 @@ func TestByteCountDecimal(t *testing.T) {
 	assert.Equal(t, "12.4 MB", ByteCountDecimal(12378517))
 }
 
+func TestParseByteCountDecimal(t *testing.T) {
+	for s, expected := range map[string]int64{
+		"50":     50,
+		"5M":     5000000,
+		"1.5 MB": 1500000,
+		"500k":   500000,
+		"2g":     2000000000,
+		"10B":    10,
+	} {
+		b, err := ParseByteCountDecimal(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, expected, b, s)
+	}
+	for _, s := range []string{"", "M", "5X", "5MM", "-1k"} {
+		_, err := ParseByteCountDecimal(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
 func TestMissingChunks(t *testing.T) {
 	fileSize := 100
 	chunkSize := 10